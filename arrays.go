@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Array columns are native arrays on Postgres and JSON text on SQLite.
+// Values don't know which connection they're written to, so they encode
+// themselves for Postgres and SQLite connections convert them to JSON, see
+// sqliteConn
+type IntList []int64
+
+type StringList []string
+
+func (IntList) GormDataType(dialect gorm.Dialect) string {
+	if dialect.GetName() == "postgres" {
+		return "int[]"
+	}
+
+	return "text"
+}
+
+func (self IntList) Value() (driver.Value, error) {
+	return pq.Int64Array(self).Value()
+}
+
+func (self *IntList) Scan(src interface{}) error {
+	if data, ok := jsonSource(src); ok {
+		return json.Unmarshal(data, self)
+	}
+
+	return (*pq.Int64Array)(self).Scan(src)
+}
+
+func (StringList) GormDataType(dialect gorm.Dialect) string {
+	if dialect.GetName() == "postgres" {
+		return "text[]"
+	}
+
+	return "text"
+}
+
+func (self StringList) Value() (driver.Value, error) {
+	return pq.StringArray(self).Value()
+}
+
+func (self *StringList) Scan(src interface{}) error {
+	if data, ok := jsonSource(src); ok {
+		return json.Unmarshal(data, self)
+	}
+
+	return (*pq.StringArray)(self).Scan(src)
+}
+
+// nil stays NULL, like it does with pq
+func jsonValue(list interface{}) (driver.Value, error) {
+	data, err := json.Marshal(list)
+
+	if err != nil || string(data) == "null" {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+// Postgres array literals start with {, JSON arrays with [. Anything else
+// is left for pq to scan, or reject
+func jsonSource(src interface{}) ([]byte, bool) {
+	var data []byte
+
+	switch src := src.(type) {
+	case []byte:
+		data = src
+	case string:
+		data = []byte(src)
+	default:
+		return nil, false
+	}
+
+	return data, len(data) > 0 && data[0] == '['
+}
+
+// The go-sqlite3 driver, with arrays written as JSON
+const sqliteDriverName = "grip_sqlite3"
+
+func init() {
+	sql.Register(sqliteDriverName, &sqliteDriver{})
+}
+
+type sqliteDriver struct {
+	sqlite3.SQLiteDriver
+}
+
+func (self *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := self.SQLiteDriver.Open(dsn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// database/sql asks the connection before calling Value, everything but the
+// array types is left to the default conversion
+func (self *sqliteConn) CheckNamedValue(value *driver.NamedValue) error {
+	var err error
+
+	switch list := value.Value.(type) {
+	case IntList:
+		value.Value, err = jsonValue(list)
+	case StringList:
+		value.Value, err = jsonValue(list)
+	default:
+		return driver.ErrSkip
+	}
+
+	return err
+}
@@ -1,44 +1,549 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 )
 
+// Environment variables override the config file, GRIP_ followed by the key
+// with dots as underscores, GRIP_POSTGRES_PASSWORD for postgres.password
+const envPrefix = "GRIP"
+
+// Every field is read from the key in its config tag. Fields tagged secret
+// are masked when the config is printed
 type Config struct {
-	Address             string
-	DiscordClientID     string
-	DiscordClientSecret string
-	JwtSecret           string
-	JwtState            string
-	PostgresHost        string
-	PostgresUser        string
-	PostgresPassword    string
-	PostgresName        string
-	PostgresSSL         string
-}
-
-func loadConfig(path string) *Config {
+	Address             string        `config:"address"`
+	DiscordClientID     string        `config:"discord.client_id"`
+	DiscordClientSecret string        `config:"discord.client_secret" secret:"true"`
+	JwtSecret           string        `config:"jwt.secret" secret:"true"`
+	PostgresHost        string        `config:"postgres.host"`
+	PostgresUser        string        `config:"postgres.user"`
+	PostgresPassword    string        `config:"postgres.password" secret:"true"`
+	PostgresName        string        `config:"postgres.dbname"`
+	PostgresSSL         string        `config:"postgres.sslmode"`
+	SessionCookie       bool          `config:"session.cookie"`
+	SessionSecure       bool          `config:"session.secure"`
+	FraudExclude        bool          `config:"fraud.exclude"`
+	FraudNewAccountAge  time.Duration `config:"fraud.new_account_age"`
+	FraudBurstWindow    time.Duration `config:"fraud.burst_window"`
+	JuryWeight          float64       `config:"scoring.jury_weight"`
+	EventBus            string        `config:"events.bus"`
+
+	FraudBurstSize         int     `config:"fraud.burst_size"`
+	FraudExtremeMinVotes   int     `config:"fraud.extreme_min_votes"`
+	FraudClusterMinShared  int     `config:"fraud.cluster_min_shared"`
+	FraudClusterAgreement  float64 `config:"fraud.cluster_agreement"`
+	FraudClusterMinMembers int     `config:"fraud.cluster_min_members"`
+
+	FraudRefreshEvery time.Duration `config:"fraud.refresh_every"`
+
+	PersistedQueryStore     string `config:"persisted_queries.store"`
+	PersistedQueryManifest  string `config:"persisted_queries.manifest"`
+	PersistedQueryAllowlist bool   `config:"persisted_queries.allowlist"`
+	PersistedQuerySize      int    `config:"persisted_queries.size"`
+
+	MaxQueryDepth int `config:"limits.max_depth"`
+	MaxQueryCost  int `config:"limits.max_cost"`
+	QueryListSize int `config:"limits.list_size"`
+	MaxBatchSize  int `config:"limits.max_batch"`
+	MaxBodySize   int `config:"limits.max_body"`
+
+	IntrospectionDepth int `config:"limits.introspection_depth"`
+	IntrospectionCost  int `config:"limits.introspection_cost"`
+
+	HTTPMaxAge time.Duration `config:"http.max_age"`
+
+	HealthDetails bool `config:"health.details"`
+
+	MetricsAddress string `config:"metrics.address"`
+	MetricsToken   string `config:"metrics.token" secret:"true"`
+
+	CacheBackend string `config:"cache.backend"`
+	CacheSize    int    `config:"cache.size"`
+
+	LoaderCacheSize int           `config:"loaders.cache_size"`
+	LoaderCacheTTL  time.Duration `config:"loaders.cache_ttl"`
+
+	DatabaseDialect          string        `config:"database.dialect"`
+	DatabaseMaxOpenConns     int           `config:"database.max_open_conns"`
+	DatabaseMaxIdleConns     int           `config:"database.max_idle_conns"`
+	DatabaseConnMaxLifetime  time.Duration `config:"database.conn_max_lifetime"`
+	DatabaseConnectAttempts  int           `config:"database.connect_attempts"`
+	DatabaseConnectBackoff   time.Duration `config:"database.connect_backoff"`
+	DatabaseStatementTimeout time.Duration `config:"database.statement_timeout"`
+	SQLitePath               string        `config:"sqlite.path"`
+
+	TracingExporter    string  `config:"tracing.exporter"`
+	TracingEndpoint    string  `config:"tracing.endpoint"`
+	TracingSampleRatio float64 `config:"tracing.sample_ratio"`
+
+	LogLevel  string `config:"log.level"`
+	LogFormat string `config:"log.format"`
+
+	CORSAllowedOrigins   []string      `config:"cors.allowed_origins"`
+	CORSAllowedMethods   []string      `config:"cors.allowed_methods"`
+	CORSAllowedHeaders   []string      `config:"cors.allowed_headers"`
+	CORSExposedHeaders   []string      `config:"cors.exposed_headers"`
+	CORSAllowCredentials bool          `config:"cors.allow_credentials"`
+	CORSMaxAge           time.Duration `config:"cors.max_age"`
+
+	RateLimitStore          string            `config:"ratelimit.store"`
+	RateLimitTrustForwarded bool              `config:"ratelimit.trust_forwarded"`
+	RateLimits              map[string]string `config:"ratelimit.limits"`
+}
+
+// Reads config.toml (or .yaml, .json) from the path directory, or path
+// itself when it names a file. Without a config file only the defaults and
+// the environment apply. Every problem found is returned at once
+func loadConfig(path string) (*Config, error) {
 	config := viper.New()
 
-	config.SetConfigName("config")
-	config.AddConfigPath(".")
+	// Paths with an extension name a file, even a missing one, so a typo
+	// isn't silently replaced by the defaults
+	if info, err := os.Stat(path); filepath.Ext(path) != "" && (err != nil || !info.IsDir()) {
+		config.SetConfigFile(path)
+	} else {
+		config.SetConfigName("config")
+		config.AddConfigPath(path)
+	}
+
+	config.SetEnvPrefix(envPrefix)
+	config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	config.AutomaticEnv()
+
+	config.SetDefault("address", "127.0.0.1:8080")
+	config.SetDefault("discord.client_id", "")
+	config.SetDefault("discord.client_secret", "")
+	config.SetDefault("jwt.secret", "")
+	config.SetDefault("session.cookie", false)
+	config.SetDefault("session.secure", true)
+	config.SetDefault("fraud.exclude", false)
+	config.SetDefault("fraud.new_account_age", "24h")
+	config.SetDefault("fraud.burst_window", "10m")
+	config.SetDefault("fraud.burst_size", 3)
+	config.SetDefault("fraud.extreme_min_votes", 3)
+	config.SetDefault("fraud.cluster_min_shared", 3)
+	config.SetDefault("fraud.cluster_agreement", 0.8)
+	config.SetDefault("fraud.cluster_min_members", 3)
+	config.SetDefault("fraud.refresh_every", "15m")
+	config.SetDefault("scoring.jury_weight", 0.7)
+	config.SetDefault("events.bus", "memory")
+	config.SetDefault("persisted_queries.store", "memory")
+	config.SetDefault("persisted_queries.manifest", "")
+	config.SetDefault("persisted_queries.allowlist", false)
+	config.SetDefault("persisted_queries.size", 1000)
+	config.SetDefault("limits.max_depth", 10)
+	config.SetDefault("limits.max_cost", 10000)
+	config.SetDefault("limits.list_size", 20)
+	config.SetDefault("limits.max_batch", 10)
+	config.SetDefault("limits.max_body", 1<<20)
+	config.SetDefault("limits.introspection_depth", 15)
+	config.SetDefault("limits.introspection_cost", 100)
+	config.SetDefault("http.max_age", "0s")
+	config.SetDefault("health.details", false)
+	config.SetDefault("metrics.address", "127.0.0.1:9090")
+	config.SetDefault("metrics.token", "")
+	config.SetDefault("cache.backend", "memory")
+	config.SetDefault("cache.size", 1000)
+	config.SetDefault("loaders.cache_size", 0)
+	config.SetDefault("loaders.cache_ttl", "1m")
+	config.SetDefault("database.dialect", "postgres")
+	config.SetDefault("database.max_open_conns", 10)
+	config.SetDefault("database.max_idle_conns", 2)
+	config.SetDefault("database.conn_max_lifetime", "30m")
+	config.SetDefault("database.connect_attempts", 10)
+	config.SetDefault("database.connect_backoff", "1s")
+	config.SetDefault("database.statement_timeout", "10s")
+	config.SetDefault("sqlite.path", "grip.db")
+	config.SetDefault("tracing.exporter", "none")
+	config.SetDefault("tracing.endpoint", "localhost:4318")
+	config.SetDefault("tracing.sample_ratio", 1.0)
+	config.SetDefault("log.level", "info")
+	config.SetDefault("log.format", "json")
+	config.SetDefault("cors.allowed_origins", []string{})
+	config.SetDefault("cors.allowed_methods", []string{"GET", "HEAD", "POST"})
+	config.SetDefault("cors.allowed_headers", []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Request-ID"})
+	config.SetDefault("cors.exposed_headers", []string{
+		"ETag",
+		"X-Request-ID",
+		"Retry-After",
+		"RateLimit-Limit",
+		"RateLimit-Remaining",
+		"RateLimit-Reset",
+	})
+	config.SetDefault("cors.allow_credentials", true)
+	config.SetDefault("cors.max_age", "1h")
+	config.SetDefault("ratelimit.store", "memory")
+	config.SetDefault("ratelimit.trust_forwarded", false)
+	config.SetDefault("ratelimit.limits", defaultRateLimits)
+	config.SetDefault("postgres.host", "127.0.0.1")
+	config.SetDefault("postgres.user", "")
+	config.SetDefault("postgres.password", "")
+	config.SetDefault("postgres.dbname", "grip")
+	config.SetDefault("postgres.sslmode", "disable")
 
 	if err := config.ReadInConfig(); err != nil {
-		log.Fatal(err.Error())
+		if _, missing := err.(viper.ConfigFileNotFoundError); !missing {
+			return nil, &ConfigError{[]string{err.Error()}}
+		}
+	}
+
+	decoded, problems := decodeConfig(config)
+	decoded.RateLimits = mergeRateLimits(decoded.RateLimits)
+	problems = append(problems, decoded.validate()...)
+
+	if len(problems) > 0 {
+		return decoded, &ConfigError{problems}
+	}
+
+	return decoded, nil
+}
+
+// Viper replaces a default table as a whole, so operations missing from
+// ratelimit.limits keep their default limit here
+var defaultRateLimits = map[string]string{
+	"newProject":         "5/1h",
+	"updateRaiting":      "30/1m",
+	"updateJudgeRaiting": "30/1m",
+	"addComment":         "10/1m",
+	"login":              "10/1m",
+}
+
+// Configured keys are folded to lower case by viper, the defaults aren't
+func mergeRateLimits(configured map[string]string) map[string]string {
+	var (
+		merged = make(map[string]string)
+		seen   = make(map[string]bool)
+	)
+
+	for name, value := range configured {
+		merged[name] = value
+		seen[strings.ToLower(name)] = true
 	}
 
-	return &Config{
-		Address:             config.Get("address").(string),
-		DiscordClientID:     config.Get("discord.client_id").(string),
-		DiscordClientSecret: config.Get("discord.client_secret").(string),
-		JwtSecret:           config.Get("jwt.secret").(string),
-		JwtState:            config.Get("jwt.state").(string),
-		PostgresHost:        config.Get("postgres.host").(string),
-		PostgresUser:        config.Get("postgres.user").(string),
-		PostgresPassword:    config.Get("postgres.password").(string),
-		PostgresName:        config.Get("postgres.dbname").(string),
-		PostgresSSL:         config.Get("postgres.sslmode").(string),
+	for name, value := range defaultRateLimits {
+		if !seen[strings.ToLower(name)] {
+			merged[name] = value
+		}
 	}
+
+	return merged
+}
+
+type ConfigError struct {
+	Problems []string
+}
+
+func (self *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(self.Problems, "; ")
+}
+
+// Decoding
+//------------------------------------------------------------------------------
+
+// Converts every key to the type of its field. Mistyped values are reported
+// instead of silently becoming zero
+func decodeConfig(config *viper.Viper) (*Config, []string) {
+	var (
+		decoded  = &Config{}
+		value    = reflect.ValueOf(decoded).Elem()
+		problems []string
+	)
+
+	for i := 0; i < value.NumField(); i++ {
+		key := value.Type().Field(i).Tag.Get("config")
+
+		if key == "" {
+			continue
+		}
+
+		raw, err := configValue(config, key)
+
+		if err == nil {
+			err = decodeField(value.Field(i), raw)
+		}
+
+		if err != nil {
+			problems = append(problems, key+": "+err.Error())
+		}
+	}
+
+	return decoded, problems
+}
+
+// GRIP_JWT_SECRET_FILE=/run/secrets/jwt reads the value from the file, for
+// secrets mounted by Docker or Kubernetes
+func configValue(config *viper.Viper, key string) (interface{}, error) {
+	name := envName(key)
+	file := os.Getenv(name + "_FILE")
+
+	if file == "" {
+		return config.Get(key), nil
+	}
+
+	if os.Getenv(name) != "" {
+		return nil, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	}
+
+	data, err := ioutil.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func envName(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+func decodeField(field reflect.Value, raw interface{}) error {
+	var (
+		decoded interface{}
+		err     error
+	)
+
+	switch field.Interface().(type) {
+	case string:
+		decoded, err = cast.ToStringE(raw)
+	case bool:
+		decoded, err = cast.ToBoolE(raw)
+	case int:
+		decoded, err = cast.ToIntE(raw)
+	case float64:
+		decoded, err = cast.ToFloat64E(raw)
+	case time.Duration:
+		decoded, err = cast.ToDurationE(raw)
+	case []string:
+		// Lists from the environment are comma separated
+		if s, ok := raw.(string); ok {
+			decoded = splitList(s)
+		} else {
+			decoded, err = cast.ToStringSliceE(raw)
+		}
+	case map[string]string:
+		// Tables from the environment are JSON objects
+		decoded, err = cast.ToStringMapStringE(raw)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	if err != nil {
+		return fmt.Errorf("expected %s, got %v", field.Type(), raw)
+	}
+
+	field.Set(reflect.ValueOf(decoded))
+	return nil
+}
+
+func splitList(s string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Validation
+//------------------------------------------------------------------------------
+
+func (self *Config) validate() []string {
+	var problems []string
+
+	check := func(ok bool, key string, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	oneOf := func(key string, value string, allowed ...string) {
+		for _, option := range allowed {
+			if value == option {
+				return
+			}
+		}
+
+		check(false, key, "expected %s, got %q", strings.Join(allowed, ", "), value)
+	}
+
+	check(self.Address != "", "address", "is required")
+	check(self.JwtSecret != "", "jwt.secret", "is required, tokens would be signed without a key")
+
+	oneOf("database.dialect", self.DatabaseDialect, "postgres", "sqlite")
+	oneOf("events.bus", self.EventBus, "memory", "postgres")
+	oneOf("persisted_queries.store", self.PersistedQueryStore, "memory", "postgres")
+	oneOf("cache.backend", self.CacheBackend, "memory", "none")
+	oneOf("tracing.exporter", self.TracingExporter, "none", "stdout", "otlp")
+	oneOf("log.level", strings.ToLower(self.LogLevel), "debug", "info", "warn", "error")
+	oneOf("log.format", self.LogFormat, "json", "text")
+	oneOf("ratelimit.store", self.RateLimitStore, "memory", "postgres")
+
+	if self.DatabaseDialect != "postgres" {
+		check(self.EventBus != "postgres", "events.bus", "postgres needs database.dialect postgres")
+		check(self.RateLimitStore != "postgres", "ratelimit.store", "postgres needs database.dialect postgres")
+		check(self.PersistedQueryStore != "postgres", "persisted_queries.store", "postgres needs database.dialect postgres")
+	}
+
+	check(
+		!self.PersistedQueryAllowlist || self.PersistedQueryManifest != "",
+		"persisted_queries.allowlist", "requires persisted_queries.manifest",
+	)
+
+	check(
+		self.MetricsAddress != "" || self.MetricsToken != "",
+		"metrics.token", "is required without metrics.address, /metrics would be public",
+	)
+
+	check(self.JuryWeight >= 0 && self.JuryWeight <= 1, "scoring.jury_weight", "expected 0 to 1, got %v", self.JuryWeight)
+	check(self.FraudClusterAgreement >= 0 && self.FraudClusterAgreement <= 1, "fraud.cluster_agreement", "expected 0 to 1, got %v", self.FraudClusterAgreement)
+	check(self.TracingSampleRatio >= 0 && self.TracingSampleRatio <= 1, "tracing.sample_ratio", "expected 0 to 1, got %v", self.TracingSampleRatio)
+
+	for key, value := range map[string]int{
+		"limits.max_depth":           self.MaxQueryDepth,
+		"limits.max_cost":            self.MaxQueryCost,
+		"limits.list_size":           self.QueryListSize,
+		"limits.max_batch":           self.MaxBatchSize,
+		"limits.max_body":            self.MaxBodySize,
+		"limits.introspection_depth": self.IntrospectionDepth,
+		"limits.introspection_cost":  self.IntrospectionCost,
+		"cache.size":                 self.CacheSize,
+		"loaders.cache_size":         self.LoaderCacheSize,
+		"database.max_open_conns":    self.DatabaseMaxOpenConns,
+		"database.max_idle_conns":    self.DatabaseMaxIdleConns,
+		"database.connect_attempts":  self.DatabaseConnectAttempts,
+	} {
+		check(value >= 0, key, "can't be negative, got %d", value)
+	}
+
+	for key, value := range map[string]int{
+		"fraud.burst_size":          self.FraudBurstSize,
+		"fraud.extreme_min_votes":   self.FraudExtremeMinVotes,
+		"fraud.cluster_min_shared":  self.FraudClusterMinShared,
+		"fraud.cluster_min_members": self.FraudClusterMinMembers,
+		"persisted_queries.size":    self.PersistedQuerySize,
+	} {
+		check(value >= 1, key, "has to be at least 1, got %d", value)
+	}
+
+	for key, value := range map[string]time.Duration{
+		"fraud.new_account_age":      self.FraudNewAccountAge,
+		"fraud.burst_window":         self.FraudBurstWindow,
+		"fraud.refresh_every":        self.FraudRefreshEvery,
+		"http.max_age":               self.HTTPMaxAge,
+		"loaders.cache_ttl":          self.LoaderCacheTTL,
+		"database.conn_max_lifetime": self.DatabaseConnMaxLifetime,
+		"database.connect_backoff":   self.DatabaseConnectBackoff,
+		"database.statement_timeout": self.DatabaseStatementTimeout,
+		"cors.max_age":               self.CORSMaxAge,
+	} {
+		check(value >= 0, key, "can't be negative, got %s", value)
+	}
+
+	for _, origin := range self.CORSAllowedOrigins {
+		if err := validOrigin(origin, self.CORSAllowCredentials); err != nil {
+			check(false, "cors.allowed_origins", "%s", err)
+		}
+	}
+
+	for name, value := range self.RateLimits {
+		if _, _, err := parseRate(value); err != nil {
+			check(false, "ratelimit.limits."+name, "%s", err)
+		}
+	}
+
+	// Maps are ranged in random order
+	sort.Strings(problems)
+	return problems
+}
+
+// Printing
+//------------------------------------------------------------------------------
+
+// Writes the effective config as TOML dotted keys, secrets masked
+func (self *Config) print(w io.Writer) {
+	value := reflect.ValueOf(self).Elem()
+
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		key := field.Tag.Get("config")
+
+		if key == "" {
+			continue
+		}
+
+		fmt.Fprintf(w, "%s = %s\n", key, formatConfigValue(value.Field(i).Interface(), field.Tag.Get("secret") == "true"))
+	}
+}
+
+func formatConfigValue(v interface{}, secret bool) string {
+	switch v := v.(type) {
+	case string:
+		if secret && v != "" {
+			return `"********"`
+		}
+
+		return fmt.Sprintf("%q", v)
+	case time.Duration:
+		return fmt.Sprintf("%q", v)
+	case []string:
+		items := make([]string, len(v))
+
+		for i, item := range v {
+			items[i] = fmt.Sprintf("%q", item)
+		}
+
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]string:
+		keys := make([]string, 0, len(v))
+
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+		items := make([]string, len(keys))
+
+		for i, key := range keys {
+			items[i] = fmt.Sprintf("%s = %q", key, v[key])
+		}
+
+		return "{ " + strings.Join(items, ", ") + " }"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// `grip config check`, prints the effective config and every problem with
+// it. Returns the exit code
+func checkConfig(path string, stdout io.Writer, stderr io.Writer) int {
+	config, err := loadConfig(path)
+
+	if config != nil {
+		config.print(stdout)
+	}
+
+	if configErr, ok := err.(*ConfigError); ok {
+		for _, problem := range configErr.Problems {
+			fmt.Fprintln(stderr, problem)
+		}
+
+		return 1
+	}
+
+	return 0
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir := t.TempDir()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.toml"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := writeTestConfig(t, `
+address = "0.0.0.0:9000"
+
+[limits]
+max_depth = 5
+max_cost = 500
+
+[ratelimit.limits]
+newProject = "1/1h"
+updateRaiting = "0"
+`)
+
+	secret := filepath.Join(dir, "jwt")
+
+	if err := ioutil.WriteFile(secret, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GRIP_JWT_SECRET_FILE", secret)
+	t.Setenv("GRIP_LIMITS_MAX_COST", "42")
+	t.Setenv("GRIP_CORS_ALLOWED_METHODS", "GET, POST")
+
+	config, err := loadConfig(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, test := range map[string]struct {
+		got      interface{}
+		expected interface{}
+	}{
+		"file":                         {config.Address, "0.0.0.0:9000"},
+		"default":                      {config.CORSMaxAge, time.Hour},
+		"environment over the file":    {config.MaxQueryCost, 42},
+		"file over the default":        {config.MaxQueryDepth, 5},
+		"secret file, trimmed":         {config.JwtSecret, "hunter2"},
+		"list from the environment":    {strings.Join(config.CORSAllowedMethods, "|"), "GET|POST"},
+		"configured limit":             {config.RateLimits["newproject"], "1/1h"},
+		"disabled limit":               {config.RateLimits["updateraiting"], "0"},
+		"default limit kept":           {config.RateLimits["addComment"], "10/1m"},
+		"replaced default left out":    {config.RateLimits["newProject"], ""},
+		"every operation limited once": {len(config.RateLimits), len(defaultRateLimits)},
+	} {
+		if test.got != test.expected {
+			t.Errorf("%s: got %v, expected %v", key, test.got, test.expected)
+		}
+	}
+
+	var out bytes.Buffer
+	config.print(&out)
+
+	if strings.Contains(out.String(), "hunter2") || !strings.Contains(out.String(), `jwt.secret = "********"`) {
+		t.Errorf("secret printed:\n%s", out.String())
+	}
+
+	// A named file has to exist
+	if _, err := loadConfig(filepath.Join(dir, "missing.toml")); err == nil {
+		t.Error("expected a missing config file to fail")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		file    string
+		env     map[string]string
+		problem string // Prefix of the first problem, empty when valid
+	}{
+		{name: "defaults"},
+		{name: "no jwt secret", env: map[string]string{"GRIP_JWT_SECRET": ""}, problem: "jwt.secret: is required"},
+		{name: "secret twice", env: map[string]string{"GRIP_JWT_SECRET_FILE": "/run/secrets/jwt"}, problem: "jwt.secret: both GRIP_JWT_SECRET and GRIP_JWT_SECRET_FILE are set"},
+		{name: "mistyped", file: "[limits]\nmax_depth = \"deep\"", problem: "limits.max_depth:"},
+		{name: "negative", file: "[limits]\nmax_depth = -1", problem: "limits.max_depth: can't be negative"},
+		{name: "zero", file: "[fraud]\nburst_size = 0", problem: "fraud.burst_size: has to be at least 1"},
+		{name: "negative duration", file: "[fraud]\nrefresh_every = \"-1m\"", problem: "fraud.refresh_every: can't be negative"},
+		{name: "share", file: "[scoring]\njury_weight = 2", problem: "scoring.jury_weight: expected 0 to 1"},
+		{name: "unknown option", file: "[log]\nlevel = \"loud\"", problem: "log.level: expected debug, info, warn, error"},
+		{name: "postgres bus on sqlite", file: "[database]\ndialect = \"sqlite\"\n[events]\nbus = \"postgres\"", problem: "events.bus: postgres needs database.dialect postgres"},
+		{name: "allowlist without manifest", file: "[persisted_queries]\nallowlist = true", problem: "persisted_queries.allowlist: requires"},
+		{name: "public metrics", file: "[metrics]\naddress = \"\"", problem: "metrics.token: is required"},
+		{name: "any origin with credentials", file: "[cors]\nallowed_origins = [\"*\"]", problem: "cors.allowed_origins: * can't be combined"},
+		{name: "any origin without credentials", file: "[cors]\nallowed_origins = [\"*\"]\nallow_credentials = false"},
+		{name: "broken rate", file: "[ratelimit.limits]\nlogin = \"often\"", problem: "ratelimit.limits.login:"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("GRIP_JWT_SECRET", "secret")
+
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := loadConfig(writeTestConfig(t, test.file))
+
+			if test.problem == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			configErr, ok := err.(*ConfigError)
+
+			if !ok || !strings.HasPrefix(configErr.Problems[0], test.problem) {
+				t.Fatalf("expected %q first, got %v", test.problem, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+)
+
+type contextKey string
+
+const (
+	stateContextKey  contextKey = "state"
+	viewerContextKey contextKey = "viewer"
+	freshContextKey  contextKey = "freshness"
+)
+
+// Whoever is making the request, as resolved by the JWT middleware
+type Viewer struct {
+	ID         string
+	Authorized bool
+}
+
+var anonymous = &Viewer{}
+
+func withState(ctx context.Context, state *State) context.Context {
+	return context.WithValue(ctx, stateContextKey, state)
+}
+
+func stateFrom(ctx context.Context) *State {
+	if state, ok := ctx.Value(stateContextKey).(*State); ok {
+		return state
+	}
+
+	return nil
+}
+
+// Statements ran trough the returned Database are traced as part of ctx
+func dbFrom(ctx context.Context) *Database {
+	if state := stateFrom(ctx); state != nil && state.db != nil {
+		return state.db.withContext(ctx)
+	}
+
+	return nil
+}
+
+func withViewer(ctx context.Context, viewer *Viewer) context.Context {
+	return context.WithValue(ctx, viewerContextKey, viewer)
+}
+
+// Never returns nil, requests without a valid token get an anonymous viewer
+func viewerFrom(ctx context.Context) *Viewer {
+	if viewer, ok := ctx.Value(viewerContextKey).(*Viewer); ok {
+		return viewer
+	}
+
+	return anonymous
+}
+
+// Loads the viewers User row trough the request scoped loader, so repeated
+// calls within a request hit the loader cache
+func (self *Viewer) User(ctx context.Context) *User {
+	if !self.Authorized {
+		return nil
+	}
+
+	if item, err := loadSomething(ctx, self.ID, userLoaderKey); err == nil {
+		if user, ok := item.(User); ok {
+			return &user
+		}
+	}
+
+	return nil
+}
+
+func (self *Viewer) hasRole(ctx context.Context, role Role) bool {
+	if user := self.User(ctx); user != nil {
+		return user.hasRole(role)
+	}
+
+	return false
+}
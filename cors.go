@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Cross origin access, as configured under [cors]. Origins not allowed get
+// no CORS headers at all, so browsers keep the response from their scripts
+type CORS struct {
+	origins     map[string]bool // Exact, lower case scheme://host[:port]
+	wildcards   []originPattern
+	any         bool // A lone *, never together with credentials
+	methods     map[string]bool
+	headers     map[string]bool // Canonical header keys
+	credentials bool
+
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string // Seconds, empty leaves it to the browser
+}
+
+// https://*.example.com matches any subdomain of example.com, the apex
+// itself has to be listed on its own
+type originPattern struct {
+	prefix string // scheme://
+	suffix string // .example.com[:port]
+}
+
+func newCORS(config *Config) *CORS {
+	self := &CORS{
+		origins:       map[string]bool{},
+		methods:       map[string]bool{},
+		headers:       map[string]bool{},
+		credentials:   config.CORSAllowCredentials,
+		allowMethods:  strings.Join(config.CORSAllowedMethods, ", "),
+		allowHeaders:  strings.Join(config.CORSAllowedHeaders, ", "),
+		exposeHeaders: strings.Join(config.CORSExposedHeaders, ", "),
+	}
+
+	for _, origin := range config.CORSAllowedOrigins {
+		if err := validOrigin(origin, self.credentials); err != nil {
+			fatal("Invalid cors.allowed_origins entry", "error", err)
+		}
+
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+		switch {
+		case origin == "*":
+			self.any = true
+		case strings.Contains(origin, "://*."):
+			parts := strings.SplitN(origin, "*", 2)
+			self.wildcards = append(self.wildcards, originPattern{parts[0], parts[1]})
+		default:
+			self.origins[origin] = true
+		}
+	}
+
+	for _, method := range config.CORSAllowedMethods {
+		self.methods[strings.ToUpper(method)] = true
+	}
+
+	for _, header := range config.CORSAllowedHeaders {
+		self.headers[http.CanonicalHeaderKey(header)] = true
+	}
+
+	if config.CORSMaxAge > 0 {
+		self.maxAge = strconv.Itoa(int(config.CORSMaxAge.Seconds()))
+	}
+
+	return self
+}
+
+// Origins are scheme://host[:port], the host may start with *. for subdomains
+func validOrigin(origin string, credentials bool) error {
+	if origin == "*" {
+		if credentials {
+			return fmt.Errorf("* can't be combined with cors.allow_credentials")
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(strings.Replace(strings.TrimSuffix(origin, "/"), "://*.", "://wildcard.", 1))
+
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.User != nil {
+		return fmt.Errorf("expected scheme://host[:port], got %s", origin)
+	}
+
+	return nil
+}
+
+func (self *CORS) allowed(origin string) bool {
+	origin = strings.ToLower(origin)
+
+	if self.any || self.origins[origin] {
+		return true
+	}
+
+	for _, pattern := range self.wildcards {
+		if !strings.HasPrefix(origin, pattern.prefix) || !strings.HasSuffix(origin, pattern.suffix) {
+			continue
+		}
+
+		// What the * stands for, at least one label and nothing but labels
+		subdomain := origin[len(pattern.prefix) : len(origin)-len(pattern.suffix)]
+
+		if subdomain != "" && !strings.ContainsAny(subdomain, "/:@?#") && !strings.HasPrefix(subdomain, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Echoes the origin rather than *, so credentials keep working
+func (self *CORS) allowOrigin(w http.ResponseWriter, origin string) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+
+	if self.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Adds the CORS headers to actual requests, preflights are answered by
+// preflightHandler
+func (self *CORS) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		if origin != "" && !isPreflight(r) {
+			if self.allowed(origin) {
+				self.allowOrigin(w, origin)
+
+				if self.exposeHeaders != "" {
+					w.Header().Set("Access-Control-Expose-Headers", self.exposeHeaders)
+				}
+			} else {
+				loggerFrom(r.Context()).Warn("Rejected CORS origin", "origin", origin, "method", r.Method, "path", r.URL.Path)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OPTIONS with Access-Control-Request-Method, on any path
+func (self *CORS) preflightHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		log     = loggerFrom(r.Context())
+		origin  = r.Header.Get("Origin")
+		method  = r.Header.Get("Access-Control-Request-Method")
+		headers = r.Header.Get("Access-Control-Request-Headers")
+	)
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if origin == "" || !self.allowed(origin) {
+		log.Warn("Rejected CORS preflight origin", "origin", origin, "path", r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !self.methods[strings.ToUpper(method)] {
+		log.Warn("Rejected CORS preflight method", "origin", origin, "method", method, "path", r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	for _, header := range strings.Split(headers, ",") {
+		if header = strings.TrimSpace(header); header != "" && !self.headers[http.CanonicalHeaderKey(header)] {
+			log.Warn("Rejected CORS preflight header", "origin", origin, "header", header, "path", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	self.allowOrigin(w, origin)
+	w.Header().Set("Access-Control-Allow-Methods", self.allowMethods)
+
+	if self.allowHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", self.allowHeaders)
+	}
+
+	if self.maxAge != "" {
+		w.Header().Set("Access-Control-Max-Age", self.maxAge)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// Registered ahead of every other route, so preflights to routes limited to
+// other methods still get an answer
+func (self *CORS) registerRoutes(router *mux.Router) {
+	router.Methods(http.MethodOptions).
+		Headers("Access-Control-Request-Method", "").
+		HandlerFunc(self.preflightHandler)
+}
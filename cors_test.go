@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORSOrigins(t *testing.T) {
+	cors := newCORS(&Config{CORSAllowedOrigins: []string{"https://grip.example.com/", "https://*.preview.example.com"}})
+
+	for origin, allowed := range map[string]bool{
+		"https://grip.example.com":              true,
+		"HTTPS://GRIP.EXAMPLE.COM":              true,
+		"http://grip.example.com":               false,
+		"https://grip.example.com:8443":         false,
+		"https://pr-1.preview.example.com":      true,
+		"https://a.b.preview.example.com":       true,
+		"https://preview.example.com":           false,
+		"https://.preview.example.com":          false,
+		"https://evil.com/.preview.example.com": false,
+		"https://evil.com?.preview.example.com": false,
+		"https://grip.example.com.evil.com":     false,
+	} {
+		if cors.allowed(origin) != allowed {
+			t.Errorf("%s: allowed %v, expected %v", origin, !allowed, allowed)
+		}
+	}
+}
+
+func TestValidOrigin(t *testing.T) {
+	for _, test := range []struct {
+		origin      string
+		credentials bool
+		valid       bool
+	}{
+		{"*", false, true},
+		{"*", true, false},
+		{"https://grip.example.com", true, true},
+		{"https://*.example.com", true, true},
+		{"grip.example.com", false, false},
+		{"https://grip.example.com/path", false, false},
+		{"https://user@grip.example.com", false, false},
+	} {
+		if err := validOrigin(test.origin, test.credentials); (err == nil) != test.valid {
+			t.Errorf("%s with credentials %v: got %v, expected valid %v", test.origin, test.credentials, err, test.valid)
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	cors := newCORS(&Config{
+		CORSAllowedOrigins:   []string{"https://grip.example.com"},
+		CORSAllowedMethods:   []string{"GET", "POST"},
+		CORSAllowedHeaders:   []string{"Content-Type", "Authorization"},
+		CORSAllowCredentials: true,
+		CORSMaxAge:           10 * time.Minute,
+	})
+
+	for _, test := range []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		status  int
+	}{
+		{"allowed", "https://grip.example.com", "POST", "content-type, authorization", http.StatusNoContent},
+		{"no origin", "", "POST", "", http.StatusForbidden},
+		{"other origin", "https://evil.com", "POST", "", http.StatusForbidden},
+		{"other method", "https://grip.example.com", "DELETE", "", http.StatusForbidden},
+		{"other header", "https://grip.example.com", "POST", "Content-Type, X-Debug", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodOptions, "/graphql", nil)
+		r.Header.Set("Origin", test.origin)
+		r.Header.Set("Access-Control-Request-Method", test.method)
+		r.Header.Set("Access-Control-Request-Headers", test.headers)
+
+		w := httptest.NewRecorder()
+		cors.preflightHandler(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, expected %d", test.name, w.Code, test.status)
+		}
+
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+
+		if test.status == http.StatusNoContent {
+			if allowOrigin != test.origin || w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("%s: missing headers, got %v", test.name, w.Header())
+			}
+		} else if allowOrigin != "" {
+			t.Errorf("%s: rejected preflight allows origin %s", test.name, allowOrigin)
+		}
+	}
+}
+
+// Actual requests always run, browsers hide the response from other origins
+func TestCORSMiddleware(t *testing.T) {
+	var (
+		cors    = newCORS(&Config{CORSAllowedOrigins: []string{"https://grip.example.com"}, CORSExposedHeaders: []string{"ETag"}})
+		handler = cors.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+	)
+
+	for origin, allowed := range map[string]bool{"https://grip.example.com": true, "https://evil.com": false} {
+		r := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		r.Header.Set("Origin", origin)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: got %d with Vary %q", origin, w.Code, w.Header().Get("Vary"))
+		}
+
+		if got := w.Header().Get("Access-Control-Allow-Origin") == origin && w.Header().Get("Access-Control-Expose-Headers") == "ETag"; got != allowed {
+			t.Errorf("%s: allowed %v, expected %v, headers %v", origin, got, allowed, w.Header())
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"fmt"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
-	"github.com/lib/pq"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
 )
 
 var (
@@ -17,81 +20,328 @@ var (
 )
 
 type Database struct {
-	gorm *gorm.DB
+	gorm   *gorm.DB
+	fraud  *FraudDetector
+	events EventBus
+	cache  ResponseCache // nil when disabled
+
+	loaderCache *LoaderCache // nil when disabled
+
+	users         UserStore
+	projects      ProjectStore
+	raitings      RaitingStore
+	comments      CommentStore
+	judgeRaitings JudgeRaitingStore
+	moderation    ModerationStore
+
+	timeout    time.Duration    // database.statement_timeout, 0 disables it
+	connection *ConnectionState // nil without a gorm connection
+	logger     *slog.Logger     // Tagged with the request, see withContext
 }
 
 type Migrations struct {
-	User    *User
-	Project *Project
-	Raiting *Raiting
+	User            *User
+	Project         *Project
+	Raiting         *Raiting
+	JudgeRaiting    *JudgeRaiting
+	ModerationEntry *ModerationEntry
+	Comment         *Comment
+	PersistedQuery  *PersistedQuery
+	RateLimitBucket *RateLimitBucket
 }
 
-func migrate(db *gorm.DB) {
-	log.Println("Running auto migrate…")
+// Returns the first error hit, the remaining migrations still run
+func migrate(db *gorm.DB) error {
+	logger.Info("Running auto migrate")
 
 	migrations := Migrations{
 		&User{},
 		&Project{},
 		&Raiting{},
+		&JudgeRaiting{},
+		&ModerationEntry{},
+		&Comment{},
+		&PersistedQuery{},
+		&RateLimitBucket{},
 	}
 
-	v := reflect.ValueOf(migrations)
+	var (
+		v      = reflect.ValueOf(migrations)
+		errs   = make([]error, v.NumField())
+		result error
+	)
+
 	wg.Add(v.NumField())
 
 	for i := 0; i < v.NumField(); i++ {
 		go func(i int) {
 			defer wg.Done()
-			db.AutoMigrate(v.Field(i).Interface())
+			errs[i] = db.AutoMigrate(v.Field(i).Interface()).Error
 		}(i)
 	}
 
 	wg.Wait()
-	log.Println("Migrate complete")
+
+	for _, err := range errs {
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+
+	// Raitings used to be listed on the Project, their count is all that's
+	// still needed from them. Only ever existed on Postgres. New projects were
+	// seeded with {0,0,0,0,0}, so the list can't be trusted, the votes are
+	// counted instead
+	if result == nil && db.Dialect().GetName() == "postgres" && db.Dialect().HasColumn("projects", "raiting_ids") {
+		logger.Info("Replacing projects.raiting_ids with raiting_count")
+
+		if err := db.Exec(
+			"UPDATE projects SET raiting_count = " +
+				"(SELECT count(*) FROM raitings r WHERE r.project_id = projects.id AND r.voided_at IS NULL)",
+		).Error; err != nil {
+			result = err
+		} else {
+			result = db.Model(&Project{}).DropColumn("raiting_ids").Error
+		}
+	}
+
+	if result != nil {
+		logger.Error("Migrate failed", "error", result)
+		return result
+	}
+
+	logger.Info("Migrate complete")
+	return nil
 }
 
-func newDB(config *Config) *Database {
-	var (
-		orm       *gorm.DB
-		connected bool
-	)
+// Longest wait between two connection attempts
+const maxConnectBackoff = 30 * time.Second
 
-	for !connected {
-		log.Println("Establishing Database connection at postgres://" +
-			config.PostgresHost + "/" + config.PostgresName + "…")
+func postgresConnInfo(config *Config) string {
+	info := "host=" + config.PostgresHost +
+		" user=" + config.PostgresUser +
+		" dbname=" + config.PostgresName +
+		" sslmode=" + config.PostgresSSL +
+		" password=" + config.PostgresPassword
 
-		db, err := gorm.Open(
-			"postgres", "host="+config.PostgresHost+
-				" user="+config.PostgresUser+
-				" dbname="+config.PostgresName+
-				" sslmode="+config.PostgresSSL+
-				" password="+config.PostgresPassword)
+	// Enforced by the server on every statement, context aware or not
+	if timeout := config.DatabaseStatementTimeout; timeout > 0 {
+		info += " statement_timeout=" + strconv.FormatInt(int64(timeout/time.Millisecond), 10)
+	}
 
-		if err != nil {
-			log.Println("Failed to connect to database at " +
-				config.PostgresHost + "/" + config.PostgresName)
+	return info
+}
 
-			time.Sleep(time.Second)
-		} else {
-			log.Println("Database connection established")
-			migrate(db)
+// Where the configured database lives, for logs
+func databaseAddress(config *Config) string {
+	if config.DatabaseDialect == "sqlite" {
+		return "sqlite://" + config.SQLitePath
+	}
+
+	return "postgres://" + config.PostgresHost + "/" + config.PostgresName
+}
+
+// Opens the dialect picked by database.dialect
+func openDB(config *Config) (*gorm.DB, error) {
+	switch config.DatabaseDialect {
+	case "", "postgres":
+		db, err := gorm.Open("postgres", postgresConnInfo(config))
+
+		if err == nil {
+			db.DB().SetMaxOpenConns(config.DatabaseMaxOpenConns)
+			db.DB().SetMaxIdleConns(config.DatabaseMaxIdleConns)
+			db.DB().SetConnMaxLifetime(config.DatabaseConnMaxLifetime)
+		}
+
+		return db, err
+	case "sqlite":
+		db, err := gorm.Open("sqlite3", sqliteDriverName, config.SQLitePath)
+
+		if err == nil {
+			// SQLite allows a single writer, concurrent ones would fail
+			// with "database is locked" instead of waiting
+			db.DB().SetMaxOpenConns(1)
+			db.Exec("PRAGMA foreign_keys = ON")
+		}
+
+		return db, err
+	}
+
+	return nil, fmt.Errorf("Unknown database.dialect %s, expected postgres or sqlite", config.DatabaseDialect)
+}
+
+// Retries with an exponential backoff, until database.connect_attempts runs
+// out. 0 attempts retries forever
+func connect(config *Config) (*gorm.DB, int) {
+	delay := config.DatabaseConnectBackoff
+
+	for attempt := 1; ; attempt++ {
+		logger.Info("Establishing database connection", "address", databaseAddress(config), "attempt", attempt)
+
+		db, err := openDB(config)
+
+		if err == nil {
+			logger.Info("Database connection established", "address", databaseAddress(config))
+			return db, attempt
+		}
+
+		logger.Warn("Failed to connect to database", "address", databaseAddress(config), "attempt", attempt, "error", err)
+
+		if max := config.DatabaseConnectAttempts; max > 0 && attempt >= max {
+			fatal("Giving up on the database", "attempts", attempt)
+		}
+
+		time.Sleep(delay)
 
-			connected = true
-			orm = db
+		if delay *= 2; delay > maxConnectBackoff {
+			delay = maxConnectBackoff
 		}
 	}
+}
+
+// The event bus needs the database to load remote events, so it's attached
+// after the connection is up
+func newDB(config *Config) *Database {
+	orm, attempts := connect(config)
+	orm.SetLogger(GormLogger{})
+
+	// Every statement, at debug level
+	if config.LogLevel == "debug" {
+		orm.LogMode(true)
+	}
+
+	migrationError := migrate(orm)
+
+	store := newGormStore(orm, context.Background(), config.DatabaseStatementTimeout)
+
+	return &Database{
+		gorm:          orm,
+		fraud:         newFraudDetector(config),
+		loaderCache:   newLoaderCache(config),
+		users:         store,
+		projects:      store,
+		raitings:      store,
+		comments:      store,
+		judgeRaitings: store,
+		moderation:    store,
+		timeout:       config.DatabaseStatementTimeout,
+		connection: &ConnectionState{
+			dialect:        orm.Dialect().GetName(),
+			attempts:       attempts,
+			connectedAt:    time.Now(),
+			migrationError: migrationError,
+		},
+	}
+}
+
+// Bounds ctx by database.statement_timeout, queries ran with it are
+// cancelled on whichever ends first
+func (self *Database) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if self.timeout > 0 {
+		return context.WithTimeout(ctx, self.timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// Never nil, falls back to the global logger outside of requests
+func (self *Database) log() *slog.Logger {
+	if self.logger != nil {
+		return self.logger
+	}
 
-	return &Database{orm}
+	return logger
 }
 
 func (self *Database) close() {
 	if self.gorm != nil {
-		log.Println("Closing database connection")
+		self.log().Info("Closing database connection")
 		self.gorm.Close()
 	}
 }
 
+// Connection state
+//------------------------------------------------------------------------------
+
+// How the connection came up and how it did since, for health checks
+type ConnectionState struct {
+	sync.Mutex
+	dialect     string
+	attempts    int
+	connectedAt time.Time
+	lastError   error
+	failedAt    time.Time
+
+	migrationError error // Stays until the next start
+}
+
+type DatabaseStatus struct {
+	Up          bool       `json:"up"`
+	Dialect     string     `json:"dialect"`
+	Error       string     `json:"error,omitempty"`
+	FailedAt    *time.Time `json:"failedAt,omitempty"`
+	Attempts    int        `json:"attempts"`
+	ConnectedAt time.Time  `json:"connectedAt"`
+	Open        int        `json:"open"`
+	InUse       int        `json:"inUse"`
+	Idle        int        `json:"idle"`
+	WaitCount   int64      `json:"waitCount"`
+}
+
+// Pings the database and reports the connection pool along with it
+func (self *Database) status(ctx context.Context) DatabaseStatus {
+	if self.gorm == nil {
+		return DatabaseStatus{Up: true, Dialect: "memory"}
+	}
+
+	ctx, cancel := self.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		err   = self.gorm.DB().PingContext(ctx)
+		stats = self.gorm.DB().Stats()
+		state = self.connection
+	)
+
+	state.Lock()
+	defer state.Unlock()
+
+	if err != nil {
+		state.lastError = err
+		state.failedAt = time.Now()
+	}
+
+	status := DatabaseStatus{
+		Up:          err == nil,
+		Dialect:     state.dialect,
+		Attempts:    state.attempts,
+		ConnectedAt: state.connectedAt,
+		Open:        stats.OpenConnections,
+		InUse:       stats.InUse,
+		Idle:        stats.Idle,
+		WaitCount:   stats.WaitCount,
+	}
+
+	if state.lastError != nil {
+		failedAt := state.failedAt
+		status.Error = state.lastError.Error()
+		status.FailedAt = &failedAt
+	}
+
+	return status
+}
+
+// Whether the schema was migrated at startup, nil when it was
+func (self *Database) migrationError() error {
+	if self.connection == nil {
+		return nil
+	}
+
+	return self.connection.migrationError
+}
+
 func (self *Database) createUser(props *DiscordUser) *User {
-	log.Printf("Creating user ID: %s, Name: %s", props.ID, props.Username)
+	self.log().Info("Creating user", "user_id", props.ID)
 
 	user := User{
 		ID:            props.ID,
@@ -101,30 +351,75 @@ func (self *Database) createUser(props *DiscordUser) *User {
 		Email:         props.Email,
 	}
 
-	self.gorm.Where(&User{ID: props.ID}).FirstOrCreate(&user)
+	if err := self.users.firstOrCreateUser(&user); err != nil {
+		self.log().Error("Failed to create user", "user_id", props.ID, "error", err)
+	}
+
+	self.forget(userLoaderKey, props.ID)
 	return &user
 }
 
 //------------------------------------------------------------------------------
 func (self *Database) createProject(owner *User, props *Project) (*Project, error) {
-	if self.gorm.NewRecord(props) {
-		props.OwnerID = owner.ID
-		props.RaitingIDs = pq.Int64Array{0, 0, 0, 0, 0}
-		query := self.gorm.Create(props)
+	if props.ID != 0 {
+		return props, nil
+	}
 
-		log.Printf("Assigning Project ID: %d to User: %s\n", props.ID, owner.ID)
-		owner.ProjectID = &props.ID
-		self.gorm.First(owner).Update(owner)
+	props.OwnerID = owner.ID
+	props.Raiting = IntList{0, 0, 0, 0, 0}
 
-		return props, query.Error
+	if err := self.projects.insertProject(props); err != nil {
+		return props, err
 	}
 
-	return props, nil
+	projectsCreated.Inc()
+	self.log().Info("Assigning project to user", "project_id", props.ID, "user_id", owner.ID)
+	owner.ProjectID = &props.ID
+	err := self.users.setUserProject(owner.ID, &props.ID)
+
+	self.forget(userLoaderKey, owner.ID)
+	self.forget(projectLoaderKey, props.String())
+	self.invalidate()
+	self.events.publish(topicProjectCreated, props.String(), *props)
+
+	return props, err
 }
 
 func (self *Database) deleteProject(id uint) error {
-	req := self.gorm.Where("ID = ?", id).Delete(&Project{})
-	return req.Error
+	err := self.projects.removeProject(id)
+	self.forget(projectLoaderKey, strconv.Itoa(int(id)))
+	self.invalidate()
+	return err
+}
+
+// Single row lookups trough the stores
+func (self *Database) findUser(id string) (*User, error) {
+	users, err := self.users.findUsers([]string{id})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, &NotFoundError{"User", id}
+	}
+
+	return users[0], nil
+}
+
+func (self *Database) findProject(id uint) (*Project, error) {
+	key := strconv.Itoa(int(id))
+	projects, err := self.projects.findProjects([]string{key})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(projects) == 0 {
+		return nil, &NotFoundError{"Project", key}
+	}
+
+	return projects[0], nil
 }
 
 //------------------------------------------------------------------------------
@@ -133,49 +428,75 @@ func (self *Database) createRaiting(
 	project *Project,
 	raiting *Raiting,
 ) (*Raiting, error) {
-	if self.gorm.NewRecord(raiting) {
-		var user User
+	if raiting.ID != 0 {
+		return raiting, nil
+	}
 
-		if _, err := self.findID(&user, *ownerID); err != nil {
-			return nil, fmt.Errorf("Tried to vote with a user ID, that does not exist: %s", *ownerID)
-		}
+	if _, err := self.findUser(*ownerID); err != nil {
+		return nil, fmt.Errorf("Tried to vote with a user ID, that does not exist: %s", *ownerID)
+	}
+
+	previousRaiting, err := self.raitings.findVote(*ownerID, project.ID)
+
+	if err != nil {
+		return nil, err
+	}
 
-		// If User has already Voted, update the previous vote instead
-		var previousRaiting Raiting
-		if !self.gorm.First(&previousRaiting, &Raiting{
-			OwnerID:   *ownerID,
-			ProjectID: project.ID,
-		}).RecordNotFound() {
-			log.Printf("Updating Users: %s, existing Raiting: %d, for Project: %d", *ownerID, previousRaiting.ID, project.ID)
-			query := self.gorm.Model(&previousRaiting).Update(raiting)
-			self.recalculateProjectRaiting(project)
-			return &previousRaiting, query.Error
+	// If User has already Voted, update the previous vote instead
+	if previousRaiting != nil {
+		self.log().Info("Updating existing raiting", "user_id", *ownerID, "raiting_id", previousRaiting.ID, "project_id", project.ID)
+		previousRaiting.Design = raiting.Design
+		previousRaiting.Performance = raiting.Performance
+		previousRaiting.EaseOfUse = raiting.EaseOfUse
+		previousRaiting.Responsiveness = raiting.Responsiveness
+		previousRaiting.Motion = raiting.Motion
+
+		err := self.raitings.saveRaiting(previousRaiting)
+
+		if err == nil {
+			votesCast.Inc()
 		}
 
-		// Else proceed with a new Raiting
-		log.Printf("Assigning Raiting ID: %d to Project: %d\n", raiting.ID, project.ID)
-		raiting.OwnerID = *ownerID
-		raiting.ProjectID = project.ID
-		query := self.gorm.Create(raiting)
+		self.forget(raitingLoaderKey, previousRaiting.String())
+		self.recalculateProjectRaiting(project, self.flaggedVotes())
+		return previousRaiting, err
+	}
 
-		self.recalculateProjectRaiting(project)
-		return raiting, query.Error
+	// Else proceed with a new Raiting
+	raiting.OwnerID = *ownerID
+	raiting.ProjectID = project.ID
+	err = self.raitings.insertRaiting(raiting)
+
+	if err == nil {
+		votesCast.Inc()
 	}
 
-	return raiting, nil
+	self.log().Info("Assigned raiting to project", "raiting_id", raiting.ID, "project_id", project.ID)
+	self.forget(raitingLoaderKey, raiting.String())
+
+	self.recalculateProjectRaiting(project, self.flaggedVotes())
+	return raiting, err
 }
 
+// flagged comes from flaggedVotes, so recalculating many projects only runs
+// the fraud heuristics once
 func (self *Database) recalculateProjectRaiting(
 	project *Project,
+	flagged map[uint]bool,
 ) bool {
-	log.Printf("Recalculating Project raiting for %d", project.ID)
+	self.log().Debug("Recalculating project raiting", "project_id", project.ID)
 
-	var raitings []Raiting
-	self.gorm.Model(project).Related(&raitings)
+	votes, err := self.raitings.raitingsByProject([]string{project.String()})
+
+	if err != nil {
+		self.log().Error("Failed to load raitings for project", "project_id", project.ID, "error", err)
+		return false
+	}
+
+	raitings := excludeSuspicious(votes.active(), flagged)
 
 	var (
 		n              = len(raitings)
-		ids            = make(pq.Int64Array, n)
 		design         int
 		performance    int
 		easeOfUse      int
@@ -183,12 +504,15 @@ func (self *Database) recalculateProjectRaiting(
 		motion         int
 	)
 
+	project.RaitingCount = n
+
+	// Every vote might have been voided, so the averages have to be reset
 	if n == 0 {
-		return true
+		project.Raiting = IntList{0, 0, 0, 0, 0}
+		return self.saveRaiting(project, self.projects.saveRaitingAggregate)
 	}
 
-	for i, raiting := range raitings {
-		ids[i] = int64(raiting.ID)
+	for _, raiting := range raitings {
 		design += raiting.Design
 		performance += raiting.Performance
 		easeOfUse += raiting.EaseOfUse
@@ -196,8 +520,7 @@ func (self *Database) recalculateProjectRaiting(
 		motion += raiting.Motion
 	}
 
-	project.RaitingIDs = ids
-	project.Raiting = pq.Int64Array{
+	project.Raiting = IntList{
 		int64(design / n),
 		int64(performance / n),
 		int64(easeOfUse / n),
@@ -205,26 +528,549 @@ func (self *Database) recalculateProjectRaiting(
 		int64(motion / n),
 	}
 
-	query := self.gorm.Save(project)
-	return query.Error == nil
+	return self.saveRaiting(project, self.projects.saveRaitingAggregate)
+}
+
+// Stores recalculated averages with save and lets subscribers know
+func (self *Database) saveRaiting(project *Project, save func(*Project) error) bool {
+	if err := save(project); err != nil {
+		self.log().Error("Failed to save project raiting", "project_id", project.ID, "error", err)
+		return false
+	}
+
+	self.forget(projectLoaderKey, project.String())
+	self.invalidate()
+	self.events.publish(topicProjectRaiting, project.String(), *project)
+	return true
+}
+
+// Drops cached responses after a write to Projects or Raitings, here and on
+// every other instance
+func (self *Database) invalidate() {
+	if self.cache != nil {
+		self.cache.purge()
+	}
+
+	if self.events != nil {
+		self.events.publish(topicCachePurge, "", nil)
+	}
+}
+
+// Drops rows from the shared loader cache after writing them, here and on
+// every other instance
+func (self *Database) forget(loader key, ids ...string) {
+	self.loaderCache.forget(loader, ids...)
+
+	if self.events == nil || self.loaderCache == nil {
+		return
+	}
+
+	for _, id := range ids {
+		self.events.publish(topicCacheForget, string(loader)+":"+id, nil)
+	}
+}
+
+// Drops what a write on another instance made stale here
+func (self *Database) evict(topic Topic, id string) {
+	switch topic {
+	case topicCachePurge:
+		if self.cache != nil {
+			self.cache.purge()
+		}
+	case topicCacheForget:
+		if loader, row, ok := strings.Cut(id, ":"); ok {
+			self.loaderCache.forget(key(loader), row)
+		}
+	}
+}
+
+// Reloads the entity behind an event raised on another instance
+func (self *Database) loadEvent(topic Topic, id string) (interface{}, error) {
+	switch topic {
+	case topicProjectRaiting, topicProjectCreated:
+		projects, err := self.projects.findProjects([]string{id})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(projects) == 0 {
+			return nil, &NotFoundError{"Project", id}
+		}
+
+		return *projects[0], nil
+	case topicCommentAdded:
+		comments, err := self.comments.findComments([]string{id})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(comments) == 0 {
+			return nil, &NotFoundError{"Comment", id}
+		}
+
+		return *comments[0], nil
+	}
+
+	return nil, fmt.Errorf("Unknown event topic %s", topic)
 }
 
-// Universal versions
 //------------------------------------------------------------------------------
-func (self *Database) findID(ptr interface{}, id interface{}) (interface{}, error) {
-	ref := reflect.ValueOf(ptr)
-	req := self.gorm.First(ref.Interface(), "id = ?", id)
-	return ref.Elem().Interface(), req.Error
+func (self *Database) createComment(authorID string, project *Project, body string) (*Comment, error) {
+	comment := &Comment{AuthorID: authorID, ProjectID: project.ID, Body: body}
+
+	if err := self.comments.insertComment(comment); err != nil {
+		return nil, err
+	}
+
+	commentsPosted.Inc()
+	self.log().Info("Added comment", "comment_id", comment.ID, "project_id", project.ID, "user_id", authorID)
+	self.invalidate()
+	self.events.publish(topicCommentAdded, strconv.Itoa(int(comment.ID)), *comment)
+	return comment, nil
 }
 
-func (self *Database) findWithID(ptr interface{}, ids []string) (interface{}, error) {
-	ref := reflect.ValueOf(ptr)
-	req := self.gorm.Where("ID in (?)", ids).Find(ref.Interface())
-	return ref.Elem().Interface(), req.Error
+//------------------------------------------------------------------------------
+func (self *Database) createJudgeRaiting(
+	judgeID *string,
+	project *Project,
+	raiting *JudgeRaiting,
+) (*JudgeRaiting, error) {
+	if raiting.ID != 0 {
+		return raiting, nil
+	}
+
+	previousRaiting, err := self.judgeRaitings.findJudgeScore(*judgeID, project.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Judges can revise their score, so an existing one gets updated
+	if previousRaiting != nil {
+		self.log().Info("Updating existing judge raiting", "judge_id", *judgeID, "raiting_id", previousRaiting.ID, "project_id", project.ID)
+		previousRaiting.Design = raiting.Design
+		previousRaiting.Performance = raiting.Performance
+		previousRaiting.EaseOfUse = raiting.EaseOfUse
+		previousRaiting.Responsiveness = raiting.Responsiveness
+		previousRaiting.Motion = raiting.Motion
+		previousRaiting.Feedback = raiting.Feedback
+
+		err := self.judgeRaitings.saveJudgeRaiting(previousRaiting)
+
+		if err == nil {
+			judgeScoresCast.Inc()
+		}
+
+		self.recalculateProjectJudgeRaiting(project)
+		return previousRaiting, err
+	}
+
+	self.log().Info("Assigning judge raiting to project", "judge_id", *judgeID, "project_id", project.ID)
+	raiting.JudgeID = *judgeID
+	raiting.ProjectID = project.ID
+	err = self.judgeRaitings.insertJudgeRaiting(raiting)
+
+	if err == nil {
+		judgeScoresCast.Inc()
+	}
+
+	self.recalculateProjectJudgeRaiting(project)
+	return raiting, err
+}
+
+func (self *Database) recalculateProjectJudgeRaiting(
+	project *Project,
+) bool {
+	self.log().Debug("Recalculating project judge raiting", "project_id", project.ID)
+
+	raitings, err := self.judgeRaitings.judgeRaitingsByProject([]string{project.String()})
+
+	if err != nil {
+		self.log().Error("Failed to load judge raitings for project", "project_id", project.ID, "error", err)
+		return false
+	}
+
+	var (
+		n              = len(raitings)
+		design         int
+		performance    int
+		easeOfUse      int
+		responsiveness int
+		motion         int
+	)
+
+	project.JudgeRaitingCount = n
+	project.JudgeRaiting = IntList{0, 0, 0, 0, 0}
+
+	if n > 0 {
+		for _, raiting := range raitings {
+			design += raiting.Design
+			performance += raiting.Performance
+			easeOfUse += raiting.EaseOfUse
+			responsiveness += raiting.Responsiveness
+			motion += raiting.Motion
+		}
+
+		project.JudgeRaiting = IntList{
+			int64(design / n),
+			int64(performance / n),
+			int64(easeOfUse / n),
+			int64(responsiveness / n),
+			int64(motion / n),
+		}
+	}
+
+	return self.saveRaiting(project, self.projects.saveJudgeAggregate)
+}
+
+// Fraud detection
+//------------------------------------------------------------------------------
+
+// Runs the fraud heuristics over every vote that hasn't been voided yet
+func (self *Database) analyzeVotes() (SuspiciousVotes, error) {
+	raitings, err := self.raitings.allRaitings()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return self.fraud.analyze(raitings.active()), nil
+}
+
+// With fraud.exclude, the votes averages leave out right now, as of the last
+// refresh. Analyzed on the spot otherwise, nothing depends on them then
+func (self *Database) suspiciousVotes() (SuspiciousVotes, error) {
+	if votes, ok := self.fraud.remembered(); ok && self.fraud.exclude {
+		return votes, nil
+	}
+
+	return self.analyzeVotes()
+}
+
+// IDs of the votes to leave out of averages as of the last refresh, nil
+// unless fraud.exclude is enabled in the config
+func (self *Database) flaggedVotes() map[uint]bool {
+	return self.fraud.flagged()
+}
+
+func excludeSuspicious(raitings []Raiting, flagged map[uint]bool) []Raiting {
+	if len(flagged) == 0 {
+		return raitings
+	}
+
+	kept := raitings[:0]
+
+	for _, raiting := range raitings {
+		if !flagged[raiting.ID] {
+			kept = append(kept, raiting)
+		}
+	}
+
+	return kept
+}
+
+// Refreshes the flags and recalculates every project with them, so every
+// average leaves out the same votes suspiciousVotes lists
+func (self *Database) recalculateAllRaitings() (Projects, error) {
+	if self.fraud.exclude {
+		votes, err := self.analyzeVotes()
+
+		if err != nil {
+			return nil, err
+		}
+
+		self.fraud.remember(votes)
+	}
+
+	projects, err := self.projects.allProjects()
+
+	if err != nil {
+		return nil, err
+	}
+
+	flagged := self.flaggedVotes()
+
+	for _, project := range projects {
+		self.recalculateProjectRaiting(project, flagged)
+	}
+
+	return projects, nil
+}
+
+// Flags change as votes come in, with fraud.exclude they're refreshed every
+// fraud.refresh_every, starting right away. Votes cast in between are
+// counted until the refresh after them. Runs until the process exits
+func (self *Database) refreshFlags(every time.Duration) {
+	if !self.fraud.exclude || every <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		if _, err := self.recalculateAllRaitings(); err != nil {
+			self.log().Error("Failed to refresh fraud flags", "error", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+// Moderation
+//------------------------------------------------------------------------------
+
+// Runs a moderation action and appends it to the audit log in the same
+// transaction, so nothing is changed without leaving a trace. The
+// transaction is rolled back when ctx ends before it commits
+func (self *Database) moderate(
+	ctx context.Context,
+	entry *ModerationEntry,
+	action func(tx ModerationTx) error,
+) error {
+	if err := self.moderation.moderate(ctx, entry, action); err != nil {
+		return err
+	}
+
+	self.log().Info(
+		"Moderation",
+		"moderator_id", entry.ModeratorID,
+		"action", entry.Action,
+		"target_type", entry.TargetType,
+		"target_id", entry.TargetID,
+	)
+
+	moderationActions.WithLabelValues(string(entry.Action)).Inc()
+	self.forgetTarget(entry.TargetType, entry.TargetID)
+	self.invalidate()
+	return nil
+}
+
+// Moderation entries name their target by type, which maps onto a loader
+func (self *Database) forgetTarget(targetType string, id string) {
+	switch targetType {
+	case "User":
+		self.forget(userLoaderKey, id)
+	case "Project":
+		self.forget(projectLoaderKey, id)
+	case "Raiting":
+		self.forget(raitingLoaderKey, id)
+	}
+}
+
+func (self *Database) banUser(
+	ctx context.Context,
+	moderatorID string,
+	id string,
+	banned bool,
+	reason string,
+) (*User, error) {
+	var (
+		user   User
+		action = ModerationUnbanUser
+		at     *time.Time
+	)
+
+	if banned {
+		now := time.Now()
+		action, at = ModerationBanUser, &now
+	}
+
+	err := self.moderate(ctx, &ModerationEntry{
+		ModeratorID: moderatorID,
+		Action:      action,
+		TargetType:  "User",
+		TargetID:    id,
+		Reason:      reason,
+	}, func(tx ModerationTx) error {
+		users, err := tx.findUsers([]string{id})
+
+		if err != nil {
+			return err
+		} else if len(users) == 0 {
+			return fmt.Errorf("User %s does not exist", id)
+		}
+
+		user = *users[0]
+		user.BannedAt = at
+		return tx.setBannedAt(id, at)
+	})
+
+	return &user, err
+}
+
+func (self *Database) hideProject(
+	ctx context.Context,
+	moderatorID string,
+	id uint,
+	hidden bool,
+	reason string,
+) (*Project, error) {
+	var (
+		project Project
+		action  = ModerationUnhideProject
+		at      *time.Time
+	)
+
+	if hidden {
+		now := time.Now()
+		action, at = ModerationHideProject, &now
+	}
+
+	err := self.moderate(ctx, &ModerationEntry{
+		ModeratorID: moderatorID,
+		Action:      action,
+		TargetType:  "Project",
+		TargetID:    strconv.Itoa(int(id)),
+		Reason:      reason,
+	}, func(tx ModerationTx) error {
+		projects, err := tx.findProjects([]string{strconv.Itoa(int(id))})
+
+		if err != nil {
+			return err
+		} else if len(projects) == 0 {
+			return fmt.Errorf("Project %d does not exist", id)
+		}
+
+		project = *projects[0]
+		project.HiddenAt = at
+		return tx.setHiddenAt(id, at)
+	})
+
+	return &project, err
+}
+
+// Voided votes stay in the table, but are left out of the project averages
+func (self *Database) voidRaiting(
+	ctx context.Context,
+	moderatorID string,
+	id uint,
+	reason string,
+) (*Raiting, error) {
+	var raiting Raiting
+
+	err := self.moderate(ctx, &ModerationEntry{
+		ModeratorID: moderatorID,
+		Action:      ModerationVoidRaiting,
+		TargetType:  "Raiting",
+		TargetID:    strconv.Itoa(int(id)),
+		Reason:      reason,
+	}, func(tx ModerationTx) error {
+		raitings, err := tx.findRaitings([]string{strconv.Itoa(int(id))})
+
+		if err != nil {
+			return err
+		} else if len(raitings) == 0 {
+			return fmt.Errorf("Raiting %d does not exist", id)
+		}
+
+		raiting = *raitings[0]
+
+		if raiting.VoidedAt != nil {
+			return fmt.Errorf("Raiting %d is already voided", id)
+		}
+
+		now := time.Now()
+		raiting.VoidedAt = &now
+
+		// Another moderator voided it since it was read
+		if err := tx.voidRaiting(id, now); err == errConflict {
+			return fmt.Errorf("Raiting %d is already voided", id)
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if project, err := self.findProject(raiting.ProjectID); err == nil {
+		self.recalculateProjectRaiting(project, self.flaggedVotes())
+	}
+
+	return &raiting, nil
+}
+
+func (self *Database) transferProject(
+	ctx context.Context,
+	moderatorID string,
+	id uint,
+	ownerID string,
+	reason string,
+) (*Project, error) {
+	var (
+		project         Project
+		previousOwnerID string
+		entry           = &ModerationEntry{
+			ModeratorID: moderatorID,
+			Action:      ModerationTransferProject,
+			TargetType:  "Project",
+			TargetID:    strconv.Itoa(int(id)),
+			Reason:      reason,
+		}
+	)
+
+	err := self.moderate(ctx, entry, func(tx ModerationTx) error {
+		projects, err := tx.findProjects([]string{strconv.Itoa(int(id))})
+
+		if err != nil {
+			return err
+		} else if len(projects) == 0 {
+			return fmt.Errorf("Project %d does not exist", id)
+		}
+
+		owners, err := tx.findUsers([]string{ownerID})
+
+		if err != nil {
+			return err
+		} else if len(owners) == 0 {
+			return fmt.Errorf("User %s does not exist", ownerID)
+		}
+
+		project = *projects[0]
+		owner := owners[0]
+
+		if owner.ProjectID != nil && *owner.ProjectID != project.ID {
+			return fmt.Errorf("User %s already owns Project %d", ownerID, *owner.ProjectID)
+		}
+
+		previousOwnerID = project.OwnerID
+		entry.Details = "from " + previousOwnerID + " to " + ownerID
+
+		if err := tx.setUserProject(previousOwnerID, nil); err != nil {
+			return err
+		}
+
+		if err := tx.claimProject(ownerID, project.ID); err == errConflict {
+			return fmt.Errorf("User %s already owns a Project", ownerID)
+		} else if err != nil {
+			return err
+		}
+
+		project.OwnerID = ownerID
+
+		// Transferred by another moderator since it was read
+		if err := tx.setOwner(project.ID, previousOwnerID, ownerID); err == errConflict {
+			return fmt.Errorf("Project %d changed owner during the transfer", id)
+		} else if err != nil {
+			return err
+		}
+
+		return nil
+	})
+
+	if err == nil {
+		self.forget(userLoaderKey, previousOwnerID, ownerID)
+	}
+
+	return &project, err
 }
 
-func (self *Database) findAll(ptr interface{}) (interface{}, error) {
-	ref := reflect.ValueOf(ptr)
-	req := self.gorm.Find(ref.Interface())
-	return ref.Elem().Interface(), req.Error
+func (self *Database) moderationLog(limit int, offset int) (ModerationEntries, error) {
+	return self.moderation.moderationLog(limit, offset)
 }
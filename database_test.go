@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSQLiteMigrate(t *testing.T) {
+	db := newDB(newTestConfig(t))
+	defer db.close()
+
+	if err := db.connection.migrationError; err != nil {
+		t.Fatal("first migration:", err)
+	}
+
+	// Every start migrates again
+	if err := migrate(db.gorm); err != nil {
+		t.Fatal("second migration:", err)
+	}
+
+	for _, table := range []string{"users", "projects", "raitings", "judge_raitings", "moderation_entries", "comments", "persisted_queries", "rate_limit_buckets"} {
+		if !db.gorm.HasTable(table) {
+			t.Error("missing table", table)
+		}
+	}
+}
+
+func TestSQLiteArrays(t *testing.T) {
+	db := newDB(newTestConfig(t))
+	defer db.close()
+
+	user := &User{ID: "user", Roles: StringList{"JUDGE", "MODERATOR"}}
+	project := &Project{OwnerID: "user", Raiting: IntList{1, 2, 3, 4, 5}, JudgeRaiting: IntList{0, 0, 0, 0, 0}}
+
+	if err := db.users.saveUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.projects.insertProject(project); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored struct {
+		Raiting string
+		Roles   string
+	}
+
+	row := db.gorm.Raw("SELECT p.raiting, u.roles FROM projects p JOIN users u ON u.id = p.owner_id").Row()
+
+	if err := row.Scan(&stored.Raiting, &stored.Roles); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Raiting != "[1,2,3,4,5]" || stored.Roles != `["JUDGE","MODERATOR"]` {
+		t.Fatalf("expected JSON on SQLite, got %q and %q", stored.Raiting, stored.Roles)
+	}
+
+	users, _ := db.users.findUsers([]string{"user"})
+	projects, _ := db.projects.findProjects([]string{project.String()})
+
+	if len(users) != 1 || !reflect.DeepEqual(users[0].Roles, user.Roles) {
+		t.Fatalf("roles read back as %v", users)
+	}
+
+	if len(projects) != 1 || !reflect.DeepEqual(projects[0].Raiting, project.Raiting) {
+		t.Fatalf("raiting read back as %v", projects)
+	}
+
+	// Opening SQLite leaves other connections alone
+	if value, _ := project.Raiting.Value(); value != "{1,2,3,4,5}" {
+		t.Fatalf("expected a Postgres array, got %v", value)
+	}
+}
+
+// Store calls of a request that went away don't reach the database
+func TestSQLiteCancelledRequest(t *testing.T) {
+	db := newDB(newTestConfig(t))
+	defer db.close()
+
+	if err := db.users.saveUser(&User{ID: "user"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.withContext(ctx).users.findUsers([]string{"user"}); err == nil {
+		t.Fatal("expected the cancelled request's query to fail")
+	}
+
+	if err := db.withContext(ctx).users.saveUser(&User{ID: "other"}); err == nil {
+		t.Fatal("expected the cancelled request's write to fail")
+	}
+
+	if users, _ := db.users.allUsers(); len(users) != 1 {
+		t.Fatalf("the cancelled write went through, got %v", users)
+	}
+}
+
+// The owner comes from the loaders, which may hold a copy from before a ban
+func TestCreateProjectKeepsBan(t *testing.T) {
+	for name, open := range testDatabases {
+		t.Run(name, func(t *testing.T) {
+			db := open(newTestConfig(t))
+			defer db.close()
+
+			stale := db.createUser(&DiscordUser{ID: "owner"})
+
+			if _, err := db.banUser(context.Background(), "admin", "owner", true, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.createProject(stale, &Project{}); err != nil {
+				t.Fatal(err)
+			}
+
+			if user, _ := db.findUser("owner"); user.BannedAt == nil || user.ProjectID == nil {
+				t.Fatalf("expected a banned owner with a project, got %+v", user)
+			}
+		})
+	}
+}
+
+func TestConcurrentModeration(t *testing.T) {
+	for name, open := range testDatabases {
+		t.Run(name, func(t *testing.T) {
+			db := open(newTestConfig(t))
+			defer db.close()
+
+			var (
+				owner    = db.createUser(&DiscordUser{ID: "owner"})
+				voterID  = db.createUser(&DiscordUser{ID: "voter"}).ID
+				admins   = 8
+				voided   = make(chan error, admins)
+				wg       sync.WaitGroup
+				accepted int
+			)
+
+			project, err := db.createProject(owner, &Project{})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			vote, err := db.createRaiting(&voterID, project, &Raiting{Design: 100})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < admins; i++ {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+					_, err := db.voidRaiting(context.Background(), "admin", vote.ID, "")
+					voided <- err
+				}()
+			}
+
+			wg.Wait()
+			close(voided)
+
+			for err := range voided {
+				if err == nil {
+					accepted++
+				}
+			}
+
+			entries, _ := db.moderationLog(100, 0)
+
+			if accepted != 1 || len(entries) != 1 {
+				t.Fatalf("%d voids went trough, %d logged", accepted, len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/graph-gophers/graphql-go/errors"
+	"github.com/vektah/gqlparser"
+	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/gqlerror"
+	"github.com/vektah/gqlparser/parser"
+	"github.com/vektah/gqlparser/validator"
+)
+
+// graphql-go parses schema directives but has no hook to act on them, so the
+// operation is walked against a second copy of the schema before execution
+type DirectiveGuard struct {
+	schema   *ast.Schema
+	maxDepth int // 0 disables the limit
+	maxCost  int // 0 disables the limit
+	listSize int // Assumed length of list fields without @cost(size: …)
+
+	// __schema and __type selections get a depth limit of their own, the
+	// TypeRef fragment tools send nests ofType seven times
+	introspectionDepth int // 0 disables the limit
+	introspectionCost  int // Flat, whatever is selected below
+}
+
+// What the guard found out about an operation, before it was executed
+type QueryAnalysis struct {
+	Operation          ast.Operation `json:"operation"`
+	Depth              int           `json:"depth"`
+	IntrospectionDepth int           `json:"introspectionDepth,omitempty"`
+	Cost               int           `json:"cost"`
+
+	// Response caching, MaxAge is zero for operations that can't be cached
+	MaxAge     time.Duration `json:"-"`
+	Private    bool          `json:"-"`
+	Normalized string        `json:"-"`
+
+	Fields []string `json:"-"` // Root fields, for the rate limiter
+}
+
+func newDirectiveGuard(sdl string, config *Config) *DirectiveGuard {
+	return &DirectiveGuard{
+		schema:   gqlparser.MustLoadSchema(&ast.Source{Name: "schema", Input: sdl}),
+		maxDepth: config.MaxQueryDepth,
+		maxCost:  config.MaxQueryCost,
+		listSize: config.QueryListSize,
+
+		introspectionDepth: config.IntrospectionDepth,
+		introspectionCost:  config.IntrospectionCost,
+	}
+}
+
+// Validates the operation, enforces @hasRole and the depth and cost limits.
+// The analysis is returned whenever the operation could be measured. Read-only
+// requests, sent with GET, are refused anything but queries before @hasRole
+// runs, so they get a 405 and not a 401 or 403
+func (self *DirectiveGuard) check(
+	ctx context.Context,
+	query string,
+	operationName string,
+	readOnly bool,
+) (*QueryAnalysis, []*errors.QueryError) {
+	_, parseSpan := tracer.Start(ctx, "graphql.parse")
+	doc, err := parser.ParseQuery(&ast.Source{Input: query})
+
+	if err != nil {
+		failSpan(parseSpan, err)
+		parseSpan.End()
+		return nil, toQueryErrors(gqlerror.List{err})
+	}
+
+	parseSpan.End()
+
+	ctx, span := tracer.Start(ctx, "graphql.validate")
+	defer span.End()
+
+	if errs := validator.Validate(self.schema, doc); errs != nil {
+		failSpan(span, errs)
+		return nil, toQueryErrors(errs)
+	}
+
+	op := operation(doc, operationName)
+
+	if readOnly && op != nil && op.Operation != ast.Query {
+		return &QueryAnalysis{Operation: op.Operation}, []*errors.QueryError{{
+			Message:    fmt.Sprintf("%s operations can only be sent with POST", op.Operation),
+			Extensions: map[string]interface{}{"code": "METHOD_NOT_ALLOWED"},
+		}}
+	}
+
+	if errs := self.authorize(ctx, doc, op); errs != nil {
+		return nil, errs
+	}
+
+	analysis := self.measure(doc, op)
+	analysis.MaxAge, analysis.Private = cachePolicy(doc, op)
+	analysis.Fields = rootFields(doc, op)
+
+	if analysis.MaxAge > 0 {
+		analysis.Normalized = normalizeQuery(doc)
+	}
+
+	if self.maxDepth > 0 && analysis.Depth > self.maxDepth {
+		return analysis, []*errors.QueryError{{
+			Message:    fmt.Sprintf("query depth %d exceeds the limit of %d", analysis.Depth, self.maxDepth),
+			Extensions: map[string]interface{}{"code": "QUERY_TOO_DEEP"},
+		}}
+	}
+
+	if self.introspectionDepth > 0 && analysis.IntrospectionDepth > self.introspectionDepth {
+		return analysis, []*errors.QueryError{{
+			Message:    fmt.Sprintf("introspection depth %d exceeds the limit of %d", analysis.IntrospectionDepth, self.introspectionDepth),
+			Extensions: map[string]interface{}{"code": "QUERY_TOO_DEEP"},
+		}}
+	}
+
+	if self.maxCost > 0 && analysis.Cost > self.maxCost {
+		return analysis, []*errors.QueryError{{
+			Message:    fmt.Sprintf("query cost %d exceeds the budget of %d", analysis.Cost, self.maxCost),
+			Extensions: map[string]interface{}{"code": "QUERY_TOO_COMPLEX"},
+		}}
+	}
+
+	return analysis, nil
+}
+
+func toQueryErrors(errs gqlerror.List) []*errors.QueryError {
+	queryErrors := make([]*errors.QueryError, len(errs))
+
+	for i, err := range errs {
+		queryErrors[i] = &errors.QueryError{Message: err.Message}
+
+		for _, loc := range err.Locations {
+			queryErrors[i].Locations = append(queryErrors[i].Locations, errors.Location{
+				Line:   loc.Line,
+				Column: loc.Column,
+			})
+		}
+	}
+
+	return queryErrors
+}
+
+// Returns errors for every selected field the viewer is not allowed to see.
+// Fragments are followed, @skip / @include are ignored on purpose, so a
+// guarded field can't slip trough behind a variable
+func (self *DirectiveGuard) authorize(
+	ctx context.Context,
+	doc *ast.QueryDocument,
+	op *ast.OperationDefinition,
+) []*errors.QueryError {
+	var (
+		viewer      = viewerFrom(ctx)
+		queryErrors []*errors.QueryError
+	)
+
+	walkSelections(doc, op, func(field *ast.Field, depth int) {
+		if field.Definition == nil {
+			return
+		}
+
+		directive := field.Definition.Directives.ForName("hasRole")
+
+		if directive == nil {
+			return
+		}
+
+		role := Role(directive.Arguments.ForName("role").Value.Raw)
+
+		if viewer.hasRole(ctx, role) {
+			return
+		}
+
+		err := &errors.QueryError{
+			Message:    "not authorized to access " + field.ObjectDefinition.Name + "." + field.Name,
+			Extensions: map[string]interface{}{"code": "FORBIDDEN"},
+		}
+
+		if !viewer.Authorized {
+			err.Message = "authentication required to access " + field.ObjectDefinition.Name + "." + field.Name
+			err.Extensions["code"] = "UNAUTHENTICATED"
+		}
+
+		if field.Position != nil {
+			err.Locations = []errors.Location{{Line: field.Position.Line, Column: field.Position.Column}}
+		}
+
+		queryErrors = append(queryErrors, err)
+	})
+
+	return queryErrors
+}
+
+// Sums up the @cost of every selected field. Introspection costs a flat
+// limits.introspection_cost and its depth is measured on its own, so tooling
+// like GraphiQL keeps working under max_depth
+func (self *DirectiveGuard) measure(
+	doc *ast.QueryDocument,
+	op *ast.OperationDefinition,
+) *QueryAnalysis {
+	analysis := &QueryAnalysis{}
+
+	var cost func(set ast.SelectionSet, depth int, introspection bool) int
+	cost = func(set ast.SelectionSet, depth int, introspection bool) int {
+		total := 0
+
+		for _, selection := range set {
+			switch selection := selection.(type) {
+			case *ast.Field:
+				switch {
+				case introspection || selection.Name == "__schema" || selection.Name == "__type":
+					if depth > analysis.IntrospectionDepth {
+						analysis.IntrospectionDepth = depth
+					}
+
+					cost(selection.SelectionSet, depth+1, true)
+
+					if !introspection {
+						total += self.introspectionCost
+					}
+				default:
+					if depth > analysis.Depth {
+						analysis.Depth = depth
+					}
+
+					total += self.fieldCost(selection, cost(selection.SelectionSet, depth+1, false))
+				}
+			case *ast.InlineFragment:
+				total += cost(selection.SelectionSet, depth, introspection)
+			case *ast.FragmentSpread:
+				if fragment := doc.Fragments.ForName(selection.Name); fragment != nil {
+					total += cost(fragment.SelectionSet, depth, introspection)
+				}
+			}
+		}
+
+		return total
+	}
+
+	if op != nil {
+		analysis.Operation = op.Operation
+		analysis.Cost = cost(op.SelectionSet, 1, false)
+	}
+
+	return analysis
+}
+
+// A field costs its @cost(value: …), 1 for objects and 0 for scalars when
+// unannotated, plus its selections times the expected number of items
+func (self *DirectiveGuard) fieldCost(field *ast.Field, selections int) int {
+	var (
+		value = 0
+		size  = 1
+	)
+
+	if len(field.SelectionSet) > 0 {
+		value = 1
+	}
+
+	if field.Definition == nil {
+		return value + selections
+	}
+
+	if field.Definition.Type.Elem != nil {
+		size = self.listSize
+	}
+
+	if directive := field.Definition.Directives.ForName("cost"); directive != nil {
+		if arg := directive.Arguments.ForName("value"); arg != nil {
+			value, _ = strconv.Atoi(arg.Value.Raw)
+		}
+
+		if arg := directive.Arguments.ForName("size"); arg != nil {
+			size, _ = strconv.Atoi(arg.Value.Raw)
+		}
+	}
+
+	return value + selections*size
+}
+
+func operation(doc *ast.QueryDocument, operationName string) *ast.OperationDefinition {
+	if operationName == "" && len(doc.Operations) == 1 {
+		return doc.Operations[0]
+	}
+
+	return doc.Operations.ForName(operationName)
+}
+
+// Calls fn for every field in the operation, depth first, with fragments
+// expanded in place. Validation already rejected fragment cycles
+func walkSelections(
+	doc *ast.QueryDocument,
+	op *ast.OperationDefinition,
+	fn func(field *ast.Field, depth int),
+) {
+	if op == nil {
+		return
+	}
+
+	var walk func(set ast.SelectionSet, depth int)
+	walk = func(set ast.SelectionSet, depth int) {
+		for _, selection := range set {
+			switch selection := selection.(type) {
+			case *ast.Field:
+				fn(selection, depth)
+				walk(selection.SelectionSet, depth+1)
+			case *ast.InlineFragment:
+				walk(selection.SelectionSet, depth)
+			case *ast.FragmentSpread:
+				if fragment := doc.Fragments.ForName(selection.Name); fragment != nil {
+					walk(fragment.SelectionSet, depth)
+				}
+			}
+		}
+	}
+
+	walk(op.SelectionSet, 1)
+}
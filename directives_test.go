@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	schema "./schema"
+)
+
+func TestDirectiveGuardLimits(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxQueryDepth = 3
+	config.MaxQueryCost = 200
+	config.IntrospectionDepth = 3
+	config.IntrospectionCost = 50
+
+	guard := newDirectiveGuard(schema.GetRootSchema(), config)
+
+	for _, test := range []struct {
+		name     string
+		query    string
+		readOnly bool
+		depth    int
+		cost     int
+		code     string
+	}{
+		{
+			name:  "scalar below an object",
+			query: `{ user(id: "x") { id } }`,
+			depth: 2,
+			cost:  1,
+		},
+		{
+			name:  "list of scalars",
+			query: `{ user(id: "x") { roles } }`,
+			depth: 2,
+			cost:  1,
+		},
+		{
+			name:  "objects below a list are multiplied by its size",
+			query: `{ projects { team { id } } }`,
+			depth: 3,
+			cost:  101,
+		},
+		{
+			name:  "over budget",
+			query: `{ users { project { id } } }`,
+			depth: 3,
+			cost:  201,
+			code:  "QUERY_TOO_COMPLEX",
+		},
+		{
+			name:  "too deep",
+			query: `{ user(id: "x") { project { owner { id } } } }`,
+			depth: 4,
+			cost:  3,
+			code:  "QUERY_TOO_DEEP",
+		},
+		{
+			name:  "too deep behind a fragment",
+			query: `{ user(id: "x") { ...owned } } fragment owned on User { project { owner { id } } }`,
+			depth: 4,
+			cost:  3,
+			code:  "QUERY_TOO_DEEP",
+		},
+		{
+			name:  "introspection costs a flat amount",
+			query: `{ __schema { types { name } } }`,
+			cost:  50,
+		},
+		{
+			name:  "introspection is measured on its own",
+			query: `{ __schema { types { fields { type { name } } } } }`,
+			cost:  50,
+			code:  "QUERY_TOO_DEEP",
+		},
+		{
+			name:  "guarded field",
+			query: `{ suspiciousVotes { flags } }`,
+			code:  "UNAUTHENTICATED",
+		},
+		{
+			name:     "mutation sent with GET",
+			query:    `mutation { banUser(id: "x") { id } }`,
+			readOnly: true,
+			code:     "METHOD_NOT_ALLOWED",
+		},
+	} {
+		analysis, errs := guard.check(context.Background(), test.query, "", test.readOnly)
+		code := ""
+
+		if len(errs) > 0 {
+			code, _ = errs[0].Extensions["code"].(string)
+		}
+
+		if code != test.code {
+			t.Errorf("%s: got code %q, expected %q", test.name, code, test.code)
+		}
+
+		if analysis != nil && (analysis.Depth != test.depth || analysis.Cost != test.cost) {
+			t.Errorf("%s: got depth %d cost %d, expected %d and %d", test.name, analysis.Depth, analysis.Cost, test.depth, test.cost)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -12,6 +12,10 @@ import (
 )
 
 const (
+	// Discord IDs are snowflakes, their top 42 bits count milliseconds
+	// since the start of 2015
+	discordEpoch = 1420070400000
+
 	discordAuthURL  = "https://discordapp.com/api/oauth2/authorize"
 	discordTokenURL = "https://discordapp.com/api/oauth2/token"
 	discordUserURL  = "https://discordapp.com/api/users/@me"
@@ -43,11 +47,12 @@ func (self *DiscordOauth) callbackHandler(w http.ResponseWriter, r *http.Request
 	var (
 		queries  = mux.Vars(r)
 		ctx      = r.Context()
+		log      = loggerFrom(ctx)
 		jsonData map[string]interface{}
 	)
 
-	if queries["state"] != self.state.config.JwtState {
-		fmt.Println("State missmatch prevented in /auth/discord/callback")
+	if !self.state.jwt.checkStateCookie(w, r, queries["state"]) {
+		log.Warn("State missmatch prevented in /auth/discord/callback")
 		http.Redirect(w, r, "http://127.0.0.1:3000/", http.StatusBadRequest)
 		return
 	}
@@ -55,13 +60,10 @@ func (self *DiscordOauth) callbackHandler(w http.ResponseWriter, r *http.Request
 	token, err := self.config.Exchange(ctx, queries["code"])
 
 	if err != nil {
-		fmt.Println("Oauth2 code exchange failed")
-		fmt.Println(err.Error())
+		log.Warn("Oauth2 code exchange failed", "error", err)
 		return
 	}
 
-	fmt.Println(token.AccessToken)
-
 	// Requests user info
 	if res, err := self.config.Client(ctx, token).Get(discordUserURL); err == nil {
 		defer res.Body.Close()
@@ -77,8 +79,6 @@ func (self *DiscordOauth) callbackHandler(w http.ResponseWriter, r *http.Request
 				return
 			}
 
-			fmt.Println(safeStr(&jsonData, "username"))
-
 			auth := &DiscordAuth{token, &DiscordUser{
 				Username:      safeStr(&jsonData, "username"),
 				ID:            safeStr(&jsonData, "id"),
@@ -91,20 +91,18 @@ func (self *DiscordOauth) callbackHandler(w http.ResponseWriter, r *http.Request
 
 			if err == nil && auth.user.ID != "" {
 				// Creates a DB entry for the user
-				self.state.db.createUser(auth.user)
+				self.state.db.withContext(ctx).createUser(auth.user)
 
-				http.SetCookie(w, &http.Cookie{
-					Name:     "jwt",
-					Value:    *jwt,
-					Expires:  time.Now().Add(time.Hour),
-					HttpOnly: false,
-					Path:     "/",
-				})
+				if err := self.state.jwt.setSessionCookies(w, *jwt, token.Expiry); err != nil {
+					log.Error("Failed to set session cookies", "user_id", auth.user.ID, "error", err)
+					http.Redirect(w, r, "http://127.0.0.1:3000/", http.StatusInternalServerError)
+					return
+				}
 
 				http.Redirect(w, r, "http://127.0.0.1:3000/", http.StatusSeeOther)
 				return
 			} else {
-				fmt.Println("Failed to create JWT for user: " + auth.user.Username)
+				log.Error("Failed to create JWT", "user_id", auth.user.ID, "error", err)
 			}
 		}
 	}
@@ -114,14 +112,35 @@ func (self *DiscordOauth) callbackHandler(w http.ResponseWriter, r *http.Request
 
 // /auth/discord
 func (self *DiscordOauth) loginHandler(w http.ResponseWriter, r *http.Request) {
-	url := self.config.AuthCodeURL(self.state.config.JwtState)
+	state, err := self.state.jwt.setStateCookie(w)
+
+	if err != nil {
+		loggerFrom(r.Context()).Error("Failed to create OAuth2 state", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	url := self.config.AuthCodeURL(state)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+// /auth/logout, POST only. In cookie mode it needs the CSRF token like any
+// other mutation, so other sites can't log users out
+func (self *DiscordOauth) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if self.state.jwt.cookies && !validCSRF(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	self.state.jwt.clearSessionCookies(w)
+	http.Redirect(w, r, "http://127.0.0.1:3000/", http.StatusSeeOther)
+}
+
 func (self *DiscordOauth) registerRoutes(router *mux.Router) {
 	authRoute := router.PathPrefix("/auth").Subrouter()
 
-	authRoute.HandleFunc("/login", self.loginHandler)
+	authRoute.Handle("/login", self.state.limiter.limit("login", http.HandlerFunc(self.loginHandler)))
+	authRoute.HandleFunc("/logout", self.logoutHandler).Methods(http.MethodPost)
 	authRoute.HandleFunc("/callback", self.callbackHandler).
 		Queries("state", "{state}").
 		Queries("code", "{code}")
@@ -142,3 +161,15 @@ func safeStrPtr(json *map[string]interface{}, key string) *string {
 
 	return nil
 }
+
+// When the Discord account behind id was created, false for IDs that aren't
+// snowflakes
+func discordCreatedAt(id string) (time.Time, bool) {
+	snowflake, err := strconv.ParseUint(id, 10, 64)
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, (int64(snowflake>>22)+discordEpoch)*int64(time.Millisecond)), true
+}
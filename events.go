@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+type Topic string
+
+const (
+	topicProjectRaiting Topic = "project.raiting"
+	topicProjectCreated Topic = "project.created"
+	topicCommentAdded   Topic = "comment.added"
+
+	// Never reach subscribers, they tell the other instances what a write
+	// made stale in their caches
+	topicCachePurge  Topic = "cache.purge"
+	topicCacheForget Topic = "cache.forget" // id is <loader>:<row id>
+)
+
+// Size of each subscribers buffer, events past it are dropped
+const subscriberBuffer = 16
+
+// Fan-out of write events to GraphQL subscriptions. Every event is about a
+// single entity, identified by id, so buses spanning several instances can
+// pass the id around and load the entity again on the other side
+type EventBus interface {
+	publish(topic Topic, id string, payload interface{})
+	subscribe(ctx context.Context, topic Topic) <-chan interface{}
+	close()
+}
+
+func newEventBus(config *Config, db *Database) EventBus {
+	local := newMemoryBus()
+
+	switch config.EventBus {
+	case "postgres":
+		if db.gorm.Dialect().GetName() != "postgres" {
+			fatal("events.bus postgres needs database.dialect postgres")
+		}
+
+		return newPostgresBus(config, local, db.gorm, db.loadEvent, db.evict)
+	case "", "memory":
+		return local
+	default:
+		fatal("Unknown events.bus, expected memory or postgres", "bus", config.EventBus)
+	}
+
+	return nil
+}
+
+// Topics about caches rather than entities
+func (self Topic) cache() bool {
+	return strings.HasPrefix(string(self), "cache.")
+}
+
+// Memory bus
+//------------------------------------------------------------------------------
+
+// Only reaches subscribers of this instance
+type MemoryBus struct {
+	sync.RWMutex
+	subscribers map[Topic]map[chan interface{}]struct{}
+}
+
+func newMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		subscribers: make(map[Topic]map[chan interface{}]struct{}),
+	}
+}
+
+// Never blocks the writer, a subscriber that can't keep up misses events
+func (self *MemoryBus) publish(topic Topic, id string, payload interface{}) {
+	self.RLock()
+	defer self.RUnlock()
+
+	for ch := range self.subscribers[topic] {
+		select {
+		case ch <- payload:
+		default:
+			logger.Warn("Dropping event for a slow subscriber", "topic", topic)
+		}
+	}
+}
+
+// The returned channel is closed once ctx is done
+func (self *MemoryBus) subscribe(ctx context.Context, topic Topic) <-chan interface{} {
+	ch := make(chan interface{}, subscriberBuffer)
+
+	self.Lock()
+	if self.subscribers[topic] == nil {
+		self.subscribers[topic] = make(map[chan interface{}]struct{})
+	}
+	self.subscribers[topic][ch] = struct{}{}
+	self.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		self.Lock()
+		delete(self.subscribers[topic], ch)
+		close(ch)
+		self.Unlock()
+	}()
+
+	return ch
+}
+
+func (self *MemoryBus) close() {}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+const (
+	notifyChannel     = "grip_events"
+	listenerMinWait   = 10 * time.Second
+	listenerMaxWait   = time.Minute
+	listenerPingEvery = 90 * time.Second
+)
+
+// What goes over NOTIFY. Payloads are capped at 8000 bytes and a Project can
+// carry a base64 picture, so only the id travels and the receiver reloads it
+type notification struct {
+	Topic  Topic  `json:"topic"`
+	ID     string `json:"id"`
+	Origin string `json:"origin"`
+}
+
+// Delivers events to local subscribers right away and NOTIFYs every other
+// instance, which re-broadcast them to their own subscribers
+type PostgresBus struct {
+	local    *MemoryBus
+	gorm     *gorm.DB
+	listener *pq.Listener
+	origin   string
+	load     func(topic Topic, id string) (interface{}, error)
+	evict    func(topic Topic, id string)
+	done     chan struct{}
+}
+
+// NOTIFY goes trough the shared pool, LISTEN needs a dedicated connection
+// which pq.Listener manages
+func newPostgresBus(
+	config *Config,
+	local *MemoryBus,
+	db *gorm.DB,
+	load func(topic Topic, id string) (interface{}, error),
+	evict func(topic Topic, id string),
+) *PostgresBus {
+	origin := make([]byte, 8)
+	rand.Read(origin)
+
+	self := &PostgresBus{
+		local:  local,
+		gorm:   db,
+		origin: hex.EncodeToString(origin),
+		load:   load,
+		evict:  evict,
+		done:   make(chan struct{}),
+	}
+
+	self.listener = pq.NewListener(
+		postgresConnInfo(config),
+		listenerMinWait,
+		listenerMaxWait,
+		self.listenerEvent,
+	)
+
+	if err := self.listener.Listen(notifyChannel); err != nil {
+		logger.Warn("Failed to LISTEN, will retry on reconnect", "channel", notifyChannel, "error", err)
+	}
+
+	go self.receive()
+	return self
+}
+
+func (self *PostgresBus) publish(topic Topic, id string, payload interface{}) {
+	self.local.publish(topic, id, payload)
+
+	message, err := json.Marshal(&notification{topic, id, self.origin})
+
+	if err != nil {
+		logger.Error("Failed to encode event", "topic", topic, "error", err)
+		return
+	}
+
+	if err := self.gorm.Exec("SELECT pg_notify(?, ?)", notifyChannel, string(message)).Error; err != nil {
+		logger.Error("Failed to NOTIFY event", "topic", topic, "error", err)
+	}
+}
+
+func (self *PostgresBus) subscribe(ctx context.Context, topic Topic) <-chan interface{} {
+	return self.local.subscribe(ctx, topic)
+}
+
+func (self *PostgresBus) close() {
+	close(self.done)
+	self.listener.Close()
+}
+
+// pq reconnects and re-LISTENs on its own, events sent while it was
+// disconnected are lost though
+func (self *PostgresBus) listenerEvent(event pq.ListenerEventType, err error) {
+	switch event {
+	case pq.ListenerEventDisconnected:
+		logger.Warn("Event bus lost its connection", "error", err)
+	case pq.ListenerEventReconnected:
+		logger.Warn("Event bus reconnected, events sent in between were missed")
+	case pq.ListenerEventConnectionAttemptFailed:
+		logger.Error("Event bus failed to reconnect", "error", err)
+	}
+}
+
+func (self *PostgresBus) receive() {
+	ping := time.NewTicker(listenerPingEvery)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-self.done:
+			return
+
+		// Makes sure a silently dropped connection gets noticed
+		case <-ping.C:
+			go self.listener.Ping()
+
+		case n, ok := <-self.listener.NotificationChannel():
+			if !ok {
+				return
+			}
+
+			// nil after a reconnect
+			if n == nil {
+				continue
+			}
+
+			self.rebroadcast(n.Extra)
+		}
+	}
+}
+
+func (self *PostgresBus) rebroadcast(extra string) {
+	var message notification
+
+	if err := json.Unmarshal([]byte(extra), &message); err != nil {
+		logger.Warn("Ignoring malformed event", "event", extra, "error", err)
+		return
+	}
+
+	// Already delivered locally when it was published
+	if message.Origin == self.origin {
+		return
+	}
+
+	// Nothing to reload or deliver, the caches here only drop entries
+	if message.Topic.cache() {
+		self.evict(message.Topic, message.ID)
+		return
+	}
+
+	payload, err := self.load(message.Topic, message.ID)
+
+	if err != nil {
+		logger.Error("Failed to load a remote event", "topic", message.Topic, "id", message.ID, "error", err)
+		return
+	}
+
+	self.local.publish(message.Topic, message.ID, payload)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type VoteFlag string
+
+const (
+	// Cast shortly after the Discord account was created
+	FlagNewAccount VoteFlag = "NEW_ACCOUNT"
+	// Part of a burst of identical score vectors on the same project
+	FlagIdenticalBurst VoteFlag = "IDENTICAL_BURST"
+	// The voter never gives anything but 0 or 100
+	FlagExtremeOnly VoteFlag = "EXTREME_ONLY"
+	// The voter is part of a group that votes on the same projects the same way
+	FlagVotingCluster VoteFlag = "VOTING_CLUSTER"
+)
+
+type SuspiciousVote struct {
+	Raiting  Raiting
+	Flags    []VoteFlag
+	Excluded bool
+}
+
+type SuspiciousVotes []*SuspiciousVote
+
+// Heuristics only, a flag is a reason to look closer, not proof. Analyzing
+// every vote is too slow for the vote path, so writes reuse the flags of the
+// last refresh
+type FraudDetector struct {
+	exclude           bool          // Leave flagged votes out of project averages
+	newAccountAge     time.Duration // Votes younger than this, relative to the account, are flagged
+	burstWindow       time.Duration
+	burstSize         int     // Identical vectors within burstWindow before they're flagged
+	extremeMinVotes   int     // Votes a user needs before EXTREME_ONLY applies
+	clusterMinShared  int     // Shared projects before two users are compared
+	clusterAgreement  float64 // Share of identical vectors on shared projects
+	clusterMinMembers int
+
+	sync.RWMutex
+	latest SuspiciousVotes // nil until the first refresh
+}
+
+func newFraudDetector(config *Config) *FraudDetector {
+	return &FraudDetector{
+		exclude:           config.FraudExclude,
+		newAccountAge:     config.FraudNewAccountAge,
+		burstWindow:       config.FraudBurstWindow,
+		burstSize:         config.FraudBurstSize,
+		extremeMinVotes:   config.FraudExtremeMinVotes,
+		clusterMinShared:  config.FraudClusterMinShared,
+		clusterAgreement:  config.FraudClusterAgreement,
+		clusterMinMembers: config.FraudClusterMinMembers,
+	}
+}
+
+type scoreVector [5]int
+
+func vectorOf(raiting *Raiting) scoreVector {
+	return scoreVector{
+		raiting.Design,
+		raiting.Performance,
+		raiting.EaseOfUse,
+		raiting.Responsiveness,
+		raiting.Motion,
+	}
+}
+
+// Runs every heuristic over the votes and returns the flagged ones, ordered
+// by Raiting ID
+func (self *FraudDetector) analyze(raitings []Raiting) SuspiciousVotes {
+	flagged := make(map[uint]*SuspiciousVote)
+	flag := func(raiting *Raiting, reason VoteFlag) {
+		vote, ok := flagged[raiting.ID]
+
+		if !ok {
+			vote = &SuspiciousVote{Raiting: *raiting, Excluded: self.exclude}
+			flagged[raiting.ID] = vote
+		}
+
+		for _, existing := range vote.Flags {
+			if existing == reason {
+				return
+			}
+		}
+
+		vote.Flags = append(vote.Flags, reason)
+	}
+
+	self.detectNewAccounts(raitings, flag)
+	self.detectIdenticalBursts(raitings, flag)
+	self.detectExtremeOnly(raitings, flag)
+	self.detectClusters(raitings, flag)
+
+	votes := make(SuspiciousVotes, 0, len(flagged))
+
+	for _, vote := range flagged {
+		votes = append(votes, vote)
+	}
+
+	sort.Slice(votes, func(i, j int) bool {
+		return votes[i].Raiting.ID < votes[j].Raiting.ID
+	})
+
+	return votes
+}
+
+// Users sign up to grip right before voting, so the age of the Discord
+// account is what counts, not User.CreatedAt
+func (self *FraudDetector) detectNewAccounts(
+	raitings []Raiting,
+	flag func(*Raiting, VoteFlag),
+) {
+	for i := range raitings {
+		raiting := &raitings[i]
+
+		if at, ok := discordCreatedAt(raiting.OwnerID); ok && raiting.CreatedAt.Sub(at) < self.newAccountAge {
+			flag(raiting, FlagNewAccount)
+		}
+	}
+}
+
+// Same project, same five scores, from different users within a short window
+func (self *FraudDetector) detectIdenticalBursts(
+	raitings []Raiting,
+	flag func(*Raiting, VoteFlag),
+) {
+	type group struct {
+		project uint
+		vector  scoreVector
+	}
+
+	groups := make(map[group][]*Raiting)
+
+	for i := range raitings {
+		raiting := &raitings[i]
+		key := group{raiting.ProjectID, vectorOf(raiting)}
+		groups[key] = append(groups[key], raiting)
+	}
+
+	for _, members := range groups {
+		if len(members) < self.burstSize {
+			continue
+		}
+
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].CreatedAt.Before(members[j].CreatedAt)
+		})
+
+		// Sliding window over the creation times
+		for start, end := 0, 0; end < len(members); end++ {
+			for members[end].CreatedAt.Sub(members[start].CreatedAt) > self.burstWindow {
+				start++
+			}
+
+			if end-start+1 >= self.burstSize {
+				for _, raiting := range members[start : end+1] {
+					flag(raiting, FlagIdenticalBurst)
+				}
+			}
+		}
+	}
+}
+
+func (self *FraudDetector) detectExtremeOnly(
+	raitings []Raiting,
+	flag func(*Raiting, VoteFlag),
+) {
+	byOwner := groupByOwner(raitings)
+
+	for _, owned := range byOwner {
+		if len(owned) < self.extremeMinVotes {
+			continue
+		}
+
+		extreme := true
+
+		for _, raiting := range owned {
+			for _, score := range vectorOf(raiting) {
+				if score != 0 && score != 100 {
+					extreme = false
+				}
+			}
+		}
+
+		if extreme {
+			for _, raiting := range owned {
+				flag(raiting, FlagExtremeOnly)
+			}
+		}
+	}
+}
+
+// Links every pair of users that voted on enough of the same projects with
+// mostly identical scores, then flags the shared votes of groups that are
+// big enough to matter. Only users sharing a project are ever compared
+func (self *FraudDetector) detectClusters(
+	raitings []Raiting,
+	flag func(*Raiting, VoteFlag),
+) {
+	type pair struct {
+		a, b string // a < b
+	}
+
+	var (
+		byProject = make(map[uint][]*Raiting)
+		shared    = make(map[pair]int)
+		same      = make(map[pair][]*Raiting)
+		parent    = make(map[string]string)
+		agreed    = make(map[string][]*Raiting)
+	)
+
+	for i := range raitings {
+		raiting := &raitings[i]
+		byProject[raiting.ProjectID] = append(byProject[raiting.ProjectID], raiting)
+		parent[raiting.OwnerID] = raiting.OwnerID
+	}
+
+	for _, voters := range byProject {
+		sort.Slice(voters, func(i, j int) bool {
+			return voters[i].OwnerID < voters[j].OwnerID
+		})
+
+		for i, vote := range voters {
+			for _, other := range voters[i+1:] {
+				key := pair{vote.OwnerID, other.OwnerID}
+				shared[key]++
+
+				if vectorOf(vote) == vectorOf(other) {
+					same[key] = append(same[key], vote, other)
+				}
+			}
+		}
+	}
+
+	var find func(string) string
+	find = func(id string) string {
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+
+		return parent[id]
+	}
+
+	for key, count := range shared {
+		if count < self.clusterMinShared ||
+			float64(len(same[key])/2) < self.clusterAgreement*float64(count) {
+			continue
+		}
+
+		parent[find(key.a)] = find(key.b)
+		agreed[key.a] = append(agreed[key.a], same[key]...)
+	}
+
+	members := make(map[string]int)
+
+	for owner := range parent {
+		members[find(owner)]++
+	}
+
+	for owner, votes := range agreed {
+		if members[find(owner)] < self.clusterMinMembers {
+			continue
+		}
+
+		for _, raiting := range votes {
+			flag(raiting, FlagVotingCluster)
+		}
+	}
+}
+
+func groupByOwner(raitings []Raiting) map[string][]*Raiting {
+	byOwner := make(map[string][]*Raiting)
+
+	for i := range raitings {
+		raiting := &raitings[i]
+		byOwner[raiting.OwnerID] = append(byOwner[raiting.OwnerID], raiting)
+	}
+
+	return byOwner
+}
+
+// Refreshes
+//------------------------------------------------------------------------------
+
+// Keeps votes as the flags project averages are computed with
+func (self *FraudDetector) remember(votes SuspiciousVotes) {
+	self.Lock()
+	defer self.Unlock()
+
+	self.latest = votes
+}
+
+// The votes of the last refresh, false before the first one
+func (self *FraudDetector) remembered() (SuspiciousVotes, bool) {
+	self.RLock()
+	defer self.RUnlock()
+
+	return self.latest, self.latest != nil
+}
+
+// IDs of the votes to leave out of averages, nil unless exclude is enabled
+func (self *FraudDetector) flagged() map[uint]bool {
+	votes, ok := self.remembered()
+
+	if !self.exclude || !ok {
+		return nil
+	}
+
+	flagged := make(map[uint]bool, len(votes))
+
+	for _, vote := range votes {
+		flagged[vote.Raiting.ID] = true
+	}
+
+	return flagged
+}
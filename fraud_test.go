@@ -0,0 +1,226 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// A Discord ID for an account created at
+func testSnowflake(at time.Time) string {
+	ms := at.UnixNano()/int64(time.Millisecond) - discordEpoch
+	return strconv.FormatUint(uint64(ms)<<22, 10)
+}
+
+func TestDiscordCreatedAt(t *testing.T) {
+	for id, expected := range map[string]time.Time{
+		"175928847299117063": time.Date(2016, 4, 30, 11, 18, 25, 796*int(time.Millisecond), time.UTC),
+		"0":                  time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		if at, ok := discordCreatedAt(id); !ok || !at.Equal(expected) {
+			t.Errorf("%s: got %s, expected %s", id, at.UTC(), expected)
+		}
+	}
+
+	for _, id := range []string{"", "owner", "-1"} {
+		if _, ok := discordCreatedAt(id); ok {
+			t.Errorf("%q isn't a snowflake", id)
+		}
+	}
+}
+
+func TestNewAccountFlag(t *testing.T) {
+	var (
+		detector = &FraudDetector{newAccountAge: 24 * time.Hour, burstSize: 100, extremeMinVotes: 100, clusterMinShared: 100}
+		now      = time.Now()
+	)
+
+	for _, test := range []struct {
+		name    string
+		ownerID string
+		flagged bool
+	}{
+		{"account created an hour before", testSnowflake(now.Add(-time.Hour)), true},
+		{"account created a year before", testSnowflake(now.Add(-365 * 24 * time.Hour)), false},
+		{"not a Discord ID", "owner", false},
+	} {
+		votes := detector.analyze([]Raiting{{Model: gorm.Model{ID: 1, CreatedAt: now}, OwnerID: test.ownerID, Design: 50}})
+
+		if flagged := len(votes) == 1 && votes[0].Flags[0] == FlagNewAccount; flagged != test.flagged {
+			t.Errorf("%s: flagged %v, expected %v", test.name, flagged, test.flagged)
+		}
+	}
+}
+
+// Writes reuse the flags of the last refresh instead of analyzing every vote
+func TestFlagsRefresh(t *testing.T) {
+	config := newTestConfig(t)
+	config.FraudExclude = true
+	config.FraudNewAccountAge = 24 * time.Hour
+
+	var (
+		db      = newMemoryDatabase(config)
+		owner   = db.createUser(&DiscordUser{ID: testSnowflake(time.Now().Add(-365 * 24 * time.Hour))})
+		veteran = owner.ID
+		newbie  = db.createUser(&DiscordUser{ID: testSnowflake(time.Now())}).ID
+	)
+
+	project, err := db.createProject(owner, &Project{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vote := func(voterID string, score int) {
+		if _, err := db.createRaiting(&voterID, project, &Raiting{Design: score}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	design := func() int64 {
+		stored, _ := db.findProject(project.ID)
+		return stored.Raiting[0]
+	}
+
+	vote(veteran, 100)
+	vote(newbie, 0)
+
+	if design() != 50 {
+		t.Fatalf("nothing is flagged before the first refresh, got %d", design())
+	}
+
+	if _, err := db.recalculateAllRaitings(); err != nil {
+		t.Fatal(err)
+	}
+
+	if design() != 100 {
+		t.Fatalf("the new account's vote should be left out, got %d", design())
+	}
+
+	suspicious, _ := db.suspiciousVotes()
+
+	if len(suspicious) != 1 || suspicious[0].Raiting.OwnerID != newbie {
+		t.Fatalf("suspiciousVotes should list what averages leave out, got %v", suspicious)
+	}
+
+	// Still flagged when it's updated, flags are kept by Raiting ID
+	vote(newbie, 25)
+
+	if design() != 100 {
+		t.Fatalf("the flagged vote came back, got %d", design())
+	}
+}
+
+func TestFraudHeuristics(t *testing.T) {
+	var (
+		detector = &FraudDetector{
+			burstWindow:       10 * time.Minute,
+			burstSize:         3,
+			extremeMinVotes:   3,
+			clusterMinShared:  3,
+			clusterAgreement:  0.8,
+			clusterMinMembers: 3,
+		}
+		start = time.Now()
+	)
+
+	// Every score of the vote is score
+	vote := func(id uint, ownerID string, projectID uint, minutes int, score int) Raiting {
+		return Raiting{
+			Model:          gorm.Model{ID: id, CreatedAt: start.Add(time.Duration(minutes) * time.Minute)},
+			OwnerID:        ownerID,
+			ProjectID:      projectID,
+			Design:         score,
+			Performance:    score,
+			EaseOfUse:      score,
+			Responsiveness: score,
+			Motion:         score,
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		raitings []Raiting
+		flagged  map[uint]VoteFlag
+	}{
+		{
+			name:     "identical burst",
+			raitings: []Raiting{vote(1, "a", 1, 0, 40), vote(2, "b", 1, 1, 40), vote(3, "c", 1, 2, 40)},
+			flagged:  map[uint]VoteFlag{1: FlagIdenticalBurst, 2: FlagIdenticalBurst, 3: FlagIdenticalBurst},
+		},
+		{
+			name:     "identical but spread out",
+			raitings: []Raiting{vote(1, "a", 1, 0, 40), vote(2, "b", 1, 20, 40), vote(3, "c", 1, 40, 40)},
+			flagged:  map[uint]VoteFlag{},
+		},
+		{
+			name:     "burst of different scores",
+			raitings: []Raiting{vote(1, "a", 1, 0, 40), vote(2, "b", 1, 1, 60), vote(3, "c", 1, 2, 40)},
+			flagged:  map[uint]VoteFlag{},
+		},
+		{
+			name:     "extremes only",
+			raitings: []Raiting{vote(1, "a", 1, 0, 100), vote(2, "a", 2, 60, 0), vote(3, "a", 3, 120, 100)},
+			flagged:  map[uint]VoteFlag{1: FlagExtremeOnly, 2: FlagExtremeOnly, 3: FlagExtremeOnly},
+		},
+		{
+			name:     "too few votes to tell",
+			raitings: []Raiting{vote(1, "a", 1, 0, 100), vote(2, "a", 2, 60, 0)},
+			flagged:  map[uint]VoteFlag{},
+		},
+		{
+			name:     "not only extremes",
+			raitings: []Raiting{vote(1, "a", 1, 0, 100), vote(2, "a", 2, 60, 50), vote(3, "a", 3, 120, 100)},
+			flagged:  map[uint]VoteFlag{},
+		},
+		{
+			name: "voting cluster",
+			raitings: []Raiting{
+				vote(1, "a", 1, 0, 20), vote(2, "b", 1, 60, 20), vote(3, "c", 1, 120, 20),
+				vote(4, "a", 2, 0, 40), vote(5, "b", 2, 60, 40), vote(6, "c", 2, 120, 40),
+				vote(7, "a", 3, 0, 60), vote(8, "b", 3, 60, 60), vote(9, "c", 3, 120, 60),
+			},
+			flagged: map[uint]VoteFlag{
+				1: FlagVotingCluster, 2: FlagVotingCluster, 3: FlagVotingCluster,
+				4: FlagVotingCluster, 5: FlagVotingCluster, 6: FlagVotingCluster,
+				7: FlagVotingCluster, 8: FlagVotingCluster, 9: FlagVotingCluster,
+			},
+		},
+		{
+			name: "pair too small for a cluster",
+			raitings: []Raiting{
+				vote(1, "a", 1, 0, 20), vote(2, "b", 1, 60, 20),
+				vote(3, "a", 2, 0, 40), vote(4, "b", 2, 60, 40),
+				vote(5, "a", 3, 0, 60), vote(6, "b", 3, 60, 60),
+			},
+			flagged: map[uint]VoteFlag{},
+		},
+		{
+			name: "cluster that mostly disagrees",
+			raitings: []Raiting{
+				vote(1, "a", 1, 0, 20), vote(2, "b", 1, 60, 40), vote(3, "c", 1, 120, 60),
+				vote(4, "a", 2, 0, 40), vote(5, "b", 2, 60, 60), vote(6, "c", 2, 120, 20),
+				vote(7, "a", 3, 0, 60), vote(8, "b", 3, 60, 60), vote(9, "c", 3, 120, 60),
+			},
+			flagged: map[uint]VoteFlag{},
+		},
+	} {
+		votes := detector.analyze(test.raitings)
+		flagged := make(map[uint]VoteFlag, len(votes))
+
+		for _, vote := range votes {
+			if len(vote.Flags) != 1 {
+				t.Errorf("%s: vote %d has flags %v", test.name, vote.Raiting.ID, vote.Flags)
+			}
+
+			flagged[vote.Raiting.ID] = vote.Flags[0]
+		}
+
+		if !reflect.DeepEqual(flagged, test.flagged) {
+			t.Errorf("%s: flagged %v, expected %v", test.name, flagged, test.flagged)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Remembers the newest UpdatedAt among every entity resolved for a request.
+// Resolvers run concurrently, hence the mutex
+type Freshness struct {
+	sync.Mutex
+	latest time.Time
+	count  int
+}
+
+func withFreshness(ctx context.Context) (context.Context, *Freshness) {
+	freshness := &Freshness{}
+	return context.WithValue(ctx, freshContextKey, freshness), freshness
+}
+
+// Requests that don't track freshness, like subscriptions and batches, get
+// a throwaway tracker
+func freshnessFrom(ctx context.Context) *Freshness {
+	if freshness, ok := ctx.Value(freshContextKey).(*Freshness); ok {
+		return freshness
+	}
+
+	return &Freshness{}
+}
+
+// Records an entity, anything with an UpdatedAt field
+func touch(ctx context.Context, entity interface{}) {
+	freshness, ok := ctx.Value(freshContextKey).(*Freshness)
+
+	if !ok || entity == nil {
+		return
+	}
+
+	value := reflect.Indirect(reflect.ValueOf(entity))
+
+	if value.Kind() == reflect.Slice {
+		for i := 0; i < value.Len(); i++ {
+			touch(ctx, value.Index(i).Interface())
+		}
+
+		return
+	}
+
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	field := value.FieldByName("UpdatedAt")
+
+	if !field.IsValid() {
+		return
+	}
+
+	updatedAt, ok := field.Interface().(time.Time)
+
+	if !ok {
+		return
+	}
+
+	freshness.Lock()
+	defer freshness.Unlock()
+
+	if updatedAt.After(freshness.latest) {
+		freshness.latest = updatedAt
+	}
+
+	freshness.count++
+}
+
+// A weak validator for the response. The entity count is part of it, so
+// deleting a row changes the tag even if the newest timestamp stays put
+func (self *Freshness) etag(request *graphqlRequest, viewer *Viewer) string {
+	self.Lock()
+	defer self.Unlock()
+
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode([]interface{}{
+		request.Query,
+		request.OperationName,
+		request.Variables,
+		viewer.ID,
+		self.latest.UnixNano(),
+		self.count,
+	})
+
+	return fmt.Sprintf(`W/"%x"`, hash.Sum(nil)[:16])
+}
+
+func (self *Freshness) lastModified() (time.Time, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.latest, self.count > 0
+}
+
+func (self *Freshness) snapshot() (time.Time, int) {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.latest, self.count
+}
+
+// Replays what an earlier execution saw, for responses served from cache
+func (self *Freshness) restore(latest time.Time, count int) {
+	self.Lock()
+	defer self.Unlock()
+
+	if latest.After(self.latest) {
+		self.latest = latest
+	}
+
+	self.count += count
+}
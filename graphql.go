@@ -1,49 +1,430 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/errors"
+	"github.com/vektah/gqlparser/ast"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type GraphQL struct {
 	state   *State
 	schema  *graphql.Schema
 	loaders LoaderCollection
+	guard   *DirectiveGuard
+	queries *PersistedQueries
+	cache   ResponseCache // nil when disabled
 }
 
+// A single operation, as sent by the client. Batches are an array of these
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    *requestExtensions     `json:"extensions"`
+
+	readOnly bool // Sent with GET, only queries may run
+}
+
+const graphqlResponseType = "application/graphql-response+json"
+
 func (self *GraphQL) serve(w http.ResponseWriter, r *http.Request) {
-	var params struct {
-		Query         string                 `json:"query"`
-		OperationName string                 `json:"operationName"`
-		Variables     map[string]interface{} `json:"variables"`
-	}
+	requests, isBatch, status, err := decodeRequest(w, r, int64(self.state.config.MaxBodySize))
+
+	if err != nil {
+		if status == http.StatusMethodNotAllowed {
+			w.Header().Set("Allow", "GET, POST")
+		}
 
-	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), status)
 		return
 	}
 
 	ctx := self.loaders.attach(r.Context())
-	response := self.schema.Exec(
-		ctx,
-		params.Query,
-		params.OperationName,
-		params.Variables,
+
+	if isBatch {
+		if max := self.state.config.MaxBatchSize; max > 0 && len(requests) > max {
+			http.Error(w, fmt.Sprintf("Batch of %d operations exceeds the limit of %d", len(requests), max), http.StatusBadRequest)
+			return
+		}
+
+		if max := self.guard.maxCost; max > 0 {
+			if cost := self.batchCost(ctx, requests); cost > max {
+				http.Error(w, fmt.Sprintf("Batch cost %d exceeds the budget of %d", cost, max), http.StatusBadRequest)
+				return
+			}
+		}
+
+		responses := self.executeBatch(ctx, requests)
+		rateLimitsFrom(ctx).writeHeaders(w)
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, "application/json", http.StatusOK, responses)
+		return
+	}
+
+	ctx, freshness := withFreshness(ctx)
+
+	var (
+		request                 = &requests[0]
+		response, analysis      = self.execute(ctx, request)
+		contentType, statusCode = responseStatus(r, response)
+	)
+
+	rateLimitsFrom(ctx).writeHeaders(w)
+
+	cacheable := statusCode == http.StatusOK &&
+		len(response.Errors) == 0 &&
+		analysis != nil &&
+		analysis.Operation == ast.Query
+
+	if cacheable {
+		if self.cacheHeaders(w, r, request, freshness) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	writeJSON(w, contentType, statusCode, response)
+}
+
+// Reads the operations from a GET query string, or a POST body in
+// application/json or application/graphql. Bodies over maxBody bytes get a 413
+func decodeRequest(w http.ResponseWriter, r *http.Request, maxBody int64) ([]graphqlRequest, bool, int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		request, err := requestFromValues(r.URL.Query())
+
+		if err != nil {
+			return nil, false, http.StatusBadRequest, err
+		}
+
+		request.readOnly = true
+		return []graphqlRequest{*request}, false, http.StatusOK, nil
+	case http.MethodPost:
+	default:
+		return nil, false, http.StatusMethodNotAllowed, fmt.Errorf("Method %s is not allowed", r.Method)
+	}
+
+	if maxBody > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if _, ok := err.(*http.MaxBytesError); ok {
+		return nil, false, http.StatusRequestEntityTooLarge, fmt.Errorf("Request body exceeds %d bytes", maxBody)
+	} else if err != nil {
+		return nil, false, http.StatusBadRequest, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "application/graphql":
+		return []graphqlRequest{{
+			Query:         string(body),
+			OperationName: r.URL.Query().Get("operationName"),
+		}}, false, http.StatusOK, nil
+	case "application/json", "":
+	default:
+		return nil, false, http.StatusUnsupportedMediaType, fmt.Errorf("Unsupported Content-Type %s", mediaType)
+	}
+
+	if batched(body) {
+		var batch []graphqlRequest
+
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, true, http.StatusBadRequest, err
+		}
+
+		return batch, true, http.StatusOK, nil
+	}
+
+	var request graphqlRequest
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, false, http.StatusBadRequest, err
+	}
+
+	return []graphqlRequest{request}, false, http.StatusOK, nil
+}
+
+// variables and extensions are JSON encoded, like in a POST body
+func requestFromValues(values url.Values) (*graphqlRequest, error) {
+	request := &graphqlRequest{
+		Query:         values.Get("query"),
+		OperationName: values.Get("operationName"),
+	}
+
+	if variables := values.Get("variables"); variables != "" {
+		if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+			return nil, fmt.Errorf("Invalid variables: %s", err)
+		}
+	}
+
+	if extensions := values.Get("extensions"); extensions != "" {
+		if err := json.Unmarshal([]byte(extensions), &request.Extensions); err != nil {
+			return nil, fmt.Errorf("Invalid extensions: %s", err)
+		}
+	}
+
+	return request, nil
+}
+
+// Follows GraphQL over HTTP. Clients accepting application/graphql-response+json
+// get a 4xx when the operation couldn't be executed at all, plain
+// application/json clients get 200 for any well-formed request
+func responseStatus(r *http.Request, response *graphql.Response) (string, int) {
+	var (
+		modern = strings.Contains(r.Header.Get("Accept"), graphqlResponseType)
+		code   string
+	)
+
+	if len(response.Data) > 0 || len(response.Errors) == 0 {
+		if modern {
+			return graphqlResponseType, http.StatusOK
+		}
+
+		return "application/json", http.StatusOK
+	}
+
+	if c, ok := response.Errors[0].Extensions["code"].(string); ok {
+		code = c
+	}
+
+	// Spec requires 405 for mutations over GET regardless of the media type
+	if code == "METHOD_NOT_ALLOWED" {
+		return "application/json", http.StatusMethodNotAllowed
+	}
+
+	if !modern {
+		return "application/json", http.StatusOK
+	}
+
+	switch code {
+	case "UNAUTHENTICATED":
+		return graphqlResponseType, http.StatusUnauthorized
+	case "FORBIDDEN":
+		return graphqlResponseType, http.StatusForbidden
+	case "RATE_LIMITED":
+		return graphqlResponseType, http.StatusTooManyRequests
+	default:
+		return graphqlResponseType, http.StatusBadRequest
+	}
+}
+
+// Sets ETag, Last-Modified and Cache-Control for a successful query. Returns
+// true when the client already holds this exact response
+func (self *GraphQL) cacheHeaders(
+	w http.ResponseWriter,
+	r *http.Request,
+	request *graphqlRequest,
+	freshness *Freshness,
+) bool {
+	var (
+		viewer = viewerFrom(r.Context())
+		etag   = freshness.etag(request, viewer)
+		header = w.Header()
 	)
 
-	responseJSON, err := json.Marshal(response)
+	header.Set("ETag", etag)
+	header.Set("Vary", "Accept, Authorization, Cookie")
+
+	if latest, ok := freshness.lastModified(); ok {
+		header.Set("Last-Modified", latest.UTC().Format(http.TimeFormat))
+	}
+
+	switch maxAge := self.state.config.HTTPMaxAge; {
+	case viewer.Authorized:
+		header.Set("Cache-Control", "private, no-cache")
+	case maxAge > 0:
+		header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	default:
+		header.Set("Cache-Control", "public, no-cache")
+	}
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, contentType string, status int, v interface{}) {
+	responseJSON, err := json.Marshal(v)
 
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
 	w.Write(responseJSON)
 }
 
+// Sums the cost of every operation in the batch, so max_cost bounds the whole
+// request and not each operation on its own. Operations that don't pass the
+// guard count as 0, they fail on execution anyway
+func (self *GraphQL) batchCost(ctx context.Context, batch []graphqlRequest) int {
+	total := 0
+
+	for i := range batch {
+		query, err := self.queries.resolve(batch[i].Query, batch[i].Extensions)
+
+		if err != nil {
+			continue
+		}
+
+		if analysis, errs := self.guard.check(ctx, query, batch[i].OperationName, false); errs == nil {
+			total += analysis.Cost
+		}
+	}
+
+	return total
+}
+
+// Runs every operation concurrently on the same context, so the dataloaders
+// dedupe across the whole batch. Responses keep the order of the requests
+func (self *GraphQL) executeBatch(ctx context.Context, batch []graphqlRequest) []*graphql.Response {
+	var (
+		responses = make([]*graphql.Response, len(batch))
+		wg        sync.WaitGroup
+	)
+
+	for i := range batch {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			responses[i], _ = self.execute(ctx, &batch[i])
+		}(i)
+	}
+
+	wg.Wait()
+	return responses
+}
+
+func (self *GraphQL) execute(
+	ctx context.Context,
+	params *graphqlRequest,
+) (*graphql.Response, *QueryAnalysis) {
+	var (
+		response *graphql.Response
+		analysis *QueryAnalysis
+		start    = time.Now()
+	)
+
+	ctx, span := tracer.Start(ctx, "graphql.operation", trace.WithAttributes(
+		attribute.String("graphql.operation.name", params.OperationName),
+	))
+	defer span.End()
+
+	query, queryErr := self.queries.resolve(params.Query, params.Extensions)
+
+	if queryErr != nil {
+		response = &graphql.Response{Errors: []*errors.QueryError{queryErr}}
+	} else if checked, errs := self.guard.check(ctx, query, params.OperationName, params.readOnly); errs != nil {
+		response = &graphql.Response{Errors: errs}
+		analysis = checked
+	} else if errs := self.state.limiter.check(ctx, checked); errs != nil {
+		response = &graphql.Response{Errors: errs}
+		analysis = checked
+	} else {
+		response = self.cached(ctx, query, params, checked)
+		analysis = checked
+	}
+
+	if analysis != nil {
+		if response.Extensions == nil {
+			response.Extensions = make(map[string]interface{})
+		}
+
+		response.Extensions["cost"] = map[string]interface{}{
+			"requestedQueryCost": analysis.Cost,
+			"maximumAvailable":   self.guard.maxCost,
+			"depth":              analysis.Depth,
+			"maximumDepth":       self.guard.maxDepth,
+		}
+	}
+
+	if analysis != nil {
+		span.SetAttributes(
+			attribute.String("graphql.operation.type", string(analysis.Operation)),
+			attribute.Int("graphql.cost", analysis.Cost),
+		)
+	}
+
+	if len(response.Errors) > 0 {
+		failSpan(span, response.Errors[0])
+	}
+
+	observeOperation(self.queries.operationLabel(params.OperationName), analysis, response.Errors, start)
+	return response, analysis
+}
+
+// Executes the operation, or serves its data from the response cache
+func (self *GraphQL) cached(
+	ctx context.Context,
+	query string,
+	params *graphqlRequest,
+	analysis *QueryAnalysis,
+) *graphql.Response {
+	if self.cache == nil || analysis.MaxAge <= 0 {
+		return self.schema.Exec(ctx, query, params.OperationName, params.Variables)
+	}
+
+	var (
+		key        = responseCacheKey(ctx, params, analysis)
+		freshness  = freshnessFrom(ctx)
+		generation = self.cache.generation()
+	)
+
+	if cached, ok := self.cache.get(key); ok {
+		freshness.restore(cached.Latest, cached.Entities)
+		return &graphql.Response{Data: cached.Data}
+	}
+
+	response := self.schema.Exec(ctx, query, params.OperationName, params.Variables)
+
+	if len(response.Errors) == 0 {
+		latest, entities := freshness.snapshot()
+
+		self.cache.set(key, &CachedResponse{
+			Data:     response.Data,
+			Latest:   latest,
+			Entities: entities,
+		}, analysis.MaxAge, generation)
+	}
+
+	return response
+}
+
+// Batches are told apart from single operations by their first token
+func batched(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
 func (self *GraphQL) registerRoutes(router *mux.Router) {
+	router.HandleFunc("/graphql", self.serveWebSocket).Headers("Upgrade", "websocket")
 	router.HandleFunc("/graphql", self.serve)
 }
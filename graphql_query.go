@@ -3,11 +3,17 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"gopkg.in/validator.v2"
-	"log"
 	"reflect"
+	"strconv"
+
+	graphql "github.com/graph-gophers/graphql-go"
 )
 
+// Most entries moderationLog returns per page
+const moderationLogMaxLimit = 200
+
 var (
 	raitingPercentages = map[float64]int{
 		0: 0,
@@ -38,6 +44,12 @@ func validRaitingField(v interface{}, param string) error {
 	return nil
 }
 
+// validator.v2 keeps its functions in a map without a lock, so they're
+// registered once before any request instead of by the resolvers
+func init() {
+	validator.SetValidationFunc("validraiting", validRaitingField)
+}
+
 type Query struct{}
 
 // User
@@ -45,21 +57,28 @@ type Query struct{}
 
 func (_ *Query) User(ctx context.Context, args struct {
 	ID *string
-}) *User {
-	if item, err := loadSomething(ctx, *args.ID, userLoaderKey); err == nil {
-		if user, ok := item.(User); ok {
-			return &user
-		}
+}) (*User, error) {
+	if args.ID == nil {
+		return nil, nil
 	}
 
-	return nil
+	item, err := loadSomething(ctx, *args.ID, userLoaderKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	user := item.(User)
+	return &user, nil
 }
 
 func (self *Query) Users(ctx context.Context) *Users {
-	var users Users
+	loggerFrom(ctx).Debug("Fetching all users")
+	if users, err := dbFrom(ctx).users.allUsers(); err == nil {
+		for _, user := range users {
+			touch(ctx, user)
+		}
 
-	log.Println("Fetching all users")
-	if _, err := ctx.Value("state").(*State).db.findAll(&users); err == nil {
 		return &users
 	}
 
@@ -69,24 +88,40 @@ func (self *Query) Users(ctx context.Context) *Users {
 // Project queries
 //------------------------------------------------------------------------------
 
+// Hidden projects look exactly like missing ones to those who can't see them
 func (_ *Query) Project(ctx context.Context, args struct {
 	ID *string
-}) *Project {
-	if item, err := loadSomething(ctx, *args.ID, projectLoaderKey); err == nil {
-		if project, ok := item.(Project); ok {
-			return &project
-		}
+}) (*Project, error) {
+	if args.ID == nil {
+		return nil, nil
 	}
 
-	return nil
+	item, err := loadSomething(ctx, *args.ID, projectLoaderKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if project := item.(Project); project.visibleTo(ctx) {
+		return &project, nil
+	}
+
+	return nil, &NotFoundError{"Project", *args.ID}
 }
 
 func (_ *Query) Projects(ctx context.Context) *Projects {
-	var projects Projects
+	loggerFrom(ctx).Debug("Fetching all projects")
+	if projects, err := dbFrom(ctx).projects.allProjects(); err == nil {
+		visible := make(Projects, 0, len(projects))
+
+		for _, project := range projects {
+			if project.visibleTo(ctx) {
+				visible = append(visible, project)
+				touch(ctx, project)
+			}
+		}
 
-	log.Println("Fetching all projects")
-	if _, err := ctx.Value("state").(*State).db.findAll(&projects); err == nil {
-		return &projects
+		return &visible
 	}
 
 	return nil
@@ -103,47 +138,44 @@ func (self *Query) NewProject(ctx context.Context, args struct {
 }) *Project {
 	// TODO: Validate fields
 	// TODO: Convert base64 Picture to an actual picture and store its filename instead
+	// Authorization is handled by @hasRole(role: PARTICIPANT) in the schema
 	var (
-		db         = ctx.Value("state").(*State).db
-		authorized = ctx.Value("authorized").(bool)
+		db     = dbFrom(ctx)
+		viewer = viewerFrom(ctx)
+		log    = loggerFrom(ctx)
 	)
 
-	if authorized {
-		id := ctx.Value("user_id").(string)
-		log.Printf("Creating a project for User %s\n", id)
+	log.Info("Creating a project", "user_id", viewer.ID)
+	user := viewer.User(ctx)
 
-		if item, err := loadSomething(ctx, id, userLoaderKey); err == nil {
-			user := item.(User)
+	if user == nil {
+		log.Error("Failed to fetch authorized user", "user_id", viewer.ID)
+		return nil
+	}
 
-			// TODO: Convert the image and make the actual project
-			// Creating project here
-			if user.ProjectID != nil {
-				// log.Printf("Tried to overlap a Project for User %s", user.ID)
-				// return nil
+	// TODO: Convert the image and make the actual project
+	// Creating project here
+	if user.ProjectID != nil {
+		// log.Warn("Tried to overlap a project", "user_id", user.ID)
+		// return nil
 
-				// FIXME: Use the above, when done with debug
-				log.Printf("Deleting old Project %d for User %s\n", user.ProjectID, user.ID)
-				db.deleteProject(*user.ProjectID)
-			}
+		// FIXME: Use the above, when done with debug
+		log.Info("Deleting old project", "project_id", *user.ProjectID, "user_id", user.ID)
+		db.deleteProject(*user.ProjectID)
+	}
 
-			if project, err := db.createProject(&user, &Project{
-				Owner:       user,
-				Link:        args.Link,
-				Github:      args.Github,
-				Description: args.Description,
-				Flags:       args.Flags,
-				Picture:     args.Picture,
-				TeamUsers:   args.Team,
-				Theme:       args.Theme,
-			}); err == nil {
-				log.Printf("Created project %d for User %s\n", project.ID, user.ID)
-				return project
-			}
-		} else {
-			log.Printf("Failed to fetch authorized User %s\n", id)
-		}
-	} else {
-		log.Println("Tried to create a project for an unauthorized user")
+	if project, err := db.createProject(user, &Project{
+		Owner:       *user,
+		Link:        args.Link,
+		Github:      args.Github,
+		Description: args.Description,
+		Flags:       args.Flags,
+		Picture:     args.Picture,
+		TeamUsers:   args.Team,
+		Theme:       args.Theme,
+	}); err == nil {
+		log.Info("Created project", "project_id", project.ID, "user_id", user.ID)
+		return project
 	}
 
 	return nil
@@ -157,38 +189,326 @@ func (self *Query) UpdateRaiting(ctx context.Context, args struct {
 	Responsiveness float64 `validate:"min=0,max=100,validraiting"`
 	Motion         float64 `validate:"min=0,max=100,validraiting"`
 }) *Raiting {
-	validator.SetValidationFunc("validraiting", validRaitingField)
 	if err := validator.Validate(args); err != nil {
-		log.Printf("Project %s updateRaiting validation failed, %s\n", args.ProjectID, err.Error())
+		loggerFrom(ctx).Info("updateRaiting validation failed", "project_id", args.ProjectID, "error", err)
+		return nil
+	}
+
+	// Authorization is handled by @hasRole(role: PARTICIPANT) in the schema
+	var (
+		db = dbFrom(ctx)
+		id = viewerFrom(ctx).ID
+	)
+
+	item, err := loadSomething(ctx, args.ProjectID, projectLoaderKey)
+
+	if err != nil {
+		return nil
+	}
+
+	project := item.(Project)
+
+	if project.HiddenAt != nil {
+		loggerFrom(ctx).Warn("Tried to vote on a hidden project", "user_id", id, "project_id", project.ID)
+		return nil
+	}
+
+	loggerFrom(ctx).Info("Updating vote", "user_id", id, "project_id", project.ID)
+
+	if raiting, err := db.createRaiting(&id, &project, &Raiting{
+		Design:         raitingPercentages[args.Design],
+		Performance:    raitingPercentages[args.Performance],
+		EaseOfUse:      raitingPercentages[args.EaseOfUse],
+		Responsiveness: raitingPercentages[args.Responsiveness],
+		Motion:         raitingPercentages[args.Motion],
+	}); err == nil {
+		return raiting
+	}
+
+	return nil
+}
+
+// Authorization is handled by @hasRole(role: PARTICIPANT) in the schema
+func (self *Query) AddComment(ctx context.Context, args struct {
+	ProjectID string
+	Body      string `validate:"nonzero,max=2000"`
+}) (*Comment, error) {
+	if err := validator.Validate(args); err != nil {
+		return nil, fmt.Errorf("Invalid comment: %s", err)
+	}
+
+	item, err := loadSomething(ctx, args.ProjectID, projectLoaderKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	project := item.(Project)
+
+	if !project.visibleTo(ctx) {
+		return nil, &NotFoundError{"Project", args.ProjectID}
+	}
+
+	return dbFrom(ctx).createComment(viewerFrom(ctx).ID, &project, args.Body)
+}
+
+// Authorization is handled by @hasRole(role: JUDGE) in the schema
+func (self *Query) UpdateJudgeRaiting(ctx context.Context, args struct {
+	ProjectID      string  `validate:"nonzero"`
+	Design         float64 `validate:"min=0,max=100,validraiting"`
+	Performance    float64 `validate:"min=0,max=100,validraiting"`
+	EaseOfUse      float64 `validate:"min=0,max=100,validraiting"`
+	Responsiveness float64 `validate:"min=0,max=100,validraiting"`
+	Motion         float64 `validate:"min=0,max=100,validraiting"`
+	Feedback       *string
+}) *JudgeRaiting {
+	if err := validator.Validate(args); err != nil {
+		loggerFrom(ctx).Info("updateJudgeRaiting validation failed", "project_id", args.ProjectID, "error", err)
 		return nil
 	}
 
 	var (
-		db         = ctx.Value("state").(*State).db
-		authorized = ctx.Value("authorized").(bool)
+		db = dbFrom(ctx)
+		id = viewerFrom(ctx).ID
 	)
 
-	if authorized {
-		id := ctx.Value("user_id").(string)
-		item, err := loadSomething(ctx, args.ProjectID, projectLoaderKey)
+	item, err := loadSomething(ctx, args.ProjectID, projectLoaderKey)
+
+	if err != nil {
+		return nil
+	}
+
+	project := item.(Project)
+
+	if project.HiddenAt != nil {
+		loggerFrom(ctx).Warn("Tried to judge a hidden project", "judge_id", id, "project_id", project.ID)
+		return nil
+	}
+
+	loggerFrom(ctx).Info("Updating judge score", "judge_id", id, "project_id", project.ID)
+
+	if raiting, err := db.createJudgeRaiting(&id, &project, &JudgeRaiting{
+		Design:         raitingPercentages[args.Design],
+		Performance:    raitingPercentages[args.Performance],
+		EaseOfUse:      raitingPercentages[args.EaseOfUse],
+		Responsiveness: raitingPercentages[args.Responsiveness],
+		Motion:         raitingPercentages[args.Motion],
+		Feedback:       stringValue(args.Feedback),
+	}); err == nil {
+		return raiting
+	}
+
+	return nil
+}
 
-		if err != nil {
-			return nil
+// Moderation
+//------------------------------------------------------------------------------
+// Authorization is handled by @hasRole(role: ADMIN) in the schema
+
+func (_ *Query) BanUser(ctx context.Context, args struct {
+	ID     string
+	Reason *string
+}) (*User, error) {
+	return dbFrom(ctx).banUser(ctx, viewerFrom(ctx).ID, args.ID, true, stringValue(args.Reason))
+}
+
+func (_ *Query) UnbanUser(ctx context.Context, args struct {
+	ID     string
+	Reason *string
+}) (*User, error) {
+	return dbFrom(ctx).banUser(ctx, viewerFrom(ctx).ID, args.ID, false, stringValue(args.Reason))
+}
+
+func (_ *Query) HideProject(ctx context.Context, args struct {
+	ID     graphql.ID
+	Reason *string
+}) (*Project, error) {
+	id, err := parseID(args.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dbFrom(ctx).hideProject(ctx, viewerFrom(ctx).ID, id, true, stringValue(args.Reason))
+}
+
+func (_ *Query) UnhideProject(ctx context.Context, args struct {
+	ID     graphql.ID
+	Reason *string
+}) (*Project, error) {
+	id, err := parseID(args.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dbFrom(ctx).hideProject(ctx, viewerFrom(ctx).ID, id, false, stringValue(args.Reason))
+}
+
+func (_ *Query) VoidRaiting(ctx context.Context, args struct {
+	ID     graphql.ID
+	Reason *string
+}) (*Raiting, error) {
+	id, err := parseID(args.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dbFrom(ctx).voidRaiting(ctx, viewerFrom(ctx).ID, id, stringValue(args.Reason))
+}
+
+func (_ *Query) TransferProject(ctx context.Context, args struct {
+	ID      graphql.ID
+	OwnerID string
+	Reason  *string
+}) (*Project, error) {
+	id, err := parseID(args.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return dbFrom(ctx).transferProject(ctx, viewerFrom(ctx).ID, id, args.OwnerID, stringValue(args.Reason))
+}
+
+func (_ *Query) ModerationLog(ctx context.Context, args struct {
+	Limit  int32
+	Offset int32
+}) (ModerationEntries, error) {
+	limit, offset := int(args.Limit), int(args.Offset)
+
+	// gorm drops the LIMIT altogether when it's negative
+	if limit < 0 {
+		limit = 0
+	} else if limit > moderationLogMaxLimit {
+		limit = moderationLogMaxLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	return dbFrom(ctx).moderationLog(limit, offset)
+}
+
+// Subscriptions
+//------------------------------------------------------------------------------
+
+func (_ *Query) ProjectRatingChanged(ctx context.Context, args struct {
+	ProjectID graphql.ID
+}) (<-chan *Project, error) {
+	id, err := parseID(args.ProjectID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return projectEvents(ctx, topicProjectRaiting, func(project *Project) bool {
+		return project.ID == id
+	}), nil
+}
+
+func (_ *Query) ProjectCreated(ctx context.Context) <-chan *Project {
+	return projectEvents(ctx, topicProjectCreated, func(*Project) bool {
+		return true
+	})
+}
+
+func (_ *Query) CommentAdded(ctx context.Context, args struct {
+	ProjectID graphql.ID
+}) (<-chan *Comment, error) {
+	id, err := parseID(args.ProjectID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		events = stateFrom(ctx).events.subscribe(ctx, topicCommentAdded)
+		out    = make(chan *Comment)
+	)
+
+	go func() {
+		defer close(out)
+
+		for event := range events {
+			comment, ok := event.(Comment)
+
+			if !ok || comment.ProjectID != id || visibleProject(ctx, comment.ProjectID) == nil {
+				continue
+			}
+
+			select {
+			case out <- &comment:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+
+	return out, nil
+}
+
+// Forwards Project events the viewer is allowed to see, until ctx is done
+func projectEvents(
+	ctx context.Context,
+	topic Topic,
+	match func(*Project) bool,
+) <-chan *Project {
+	var (
+		events = stateFrom(ctx).events.subscribe(ctx, topic)
+		out    = make(chan *Project)
+	)
+
+	go func() {
+		defer close(out)
 
-		project := item.(Project)
-		log.Printf("Updating User's: %s vote on Project %d", id, project.ID)
-
-		if raiting, err := db.createRaiting(&id, &project, &Raiting{
-			Design:         raitingPercentages[args.Design],
-			Performance:    raitingPercentages[args.Performance],
-			EaseOfUse:      raitingPercentages[args.EaseOfUse],
-			Responsiveness: raitingPercentages[args.Responsiveness],
-			Motion:         raitingPercentages[args.Motion],
-		}); err != nil {
-			return raiting
+		for event := range events {
+			project, ok := event.(Project)
+
+			if !ok || !match(&project) || !project.visibleTo(ctx) {
+				continue
+			}
+
+			select {
+			case out <- &project:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+
+	return out
+}
+
+// Fraud detection
+//------------------------------------------------------------------------------
+// Authorization is handled by @hasRole(role: ADMIN) in the schema
+
+func (_ *Query) SuspiciousVotes(ctx context.Context) (SuspiciousVotes, error) {
+	return dbFrom(ctx).suspiciousVotes()
+}
+
+func (_ *Query) RecalculateRaitings(ctx context.Context) (Projects, error) {
+	loggerFrom(ctx).Info("Recalculating every project raiting", "user_id", viewerFrom(ctx).ID)
+	return dbFrom(ctx).recalculateAllRaitings()
+}
+
+func parseID(id graphql.ID) (uint, error) {
+	n, err := strconv.ParseUint(string(id), 10, 64)
+
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ID: %s", id)
 	}
 
-	return nil
+	return uint(n), nil
+}
+
+func stringValue(s *string) string {
+	if s != nil {
+		return *s
+	}
+
+	return ""
 }
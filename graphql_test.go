@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	schema "./schema"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+func newTestConfig(t *testing.T) *Config {
+	return &Config{
+		JuryWeight:              0.7,
+		FraudBurstSize:          3,
+		FraudExtremeMinVotes:    3,
+		FraudClusterMinShared:   3,
+		FraudClusterAgreement:   0.8,
+		FraudClusterMinMembers:  3,
+		MaxQueryDepth:           10,
+		MaxQueryCost:            10000,
+		QueryListSize:           20,
+		IntrospectionDepth:      15,
+		IntrospectionCost:       100,
+		DatabaseDialect:         "sqlite",
+		DatabaseConnectAttempts: 1,
+		SQLitePath:              t.TempDir() + "/grip.db",
+	}
+}
+
+// Every store the schema is tested against
+var testDatabases = map[string]func(config *Config) *Database{
+	"memory": newMemoryDatabase,
+	"sqlite": func(config *Config) *Database {
+		db := newDB(config)
+		db.events = newMemoryBus()
+		return db
+	},
+}
+
+// Runs the whole schema, guard included, against db
+func newTestGraphQL(t *testing.T, config *Config, db *Database) *GraphQL {
+	var (
+		state = &State{config: config, db: db, events: db.events}
+		sdl   = schema.GetRootSchema()
+	)
+
+	for id, roles := range map[string][]string{
+		"owner": nil,
+		"voter": nil,
+		"judge": {string(RoleJudge)},
+		"admin": {string(RoleAdmin)},
+		"heir":  nil,
+	} {
+		user := db.createUser(&DiscordUser{ID: id, Username: id})
+		user.Roles = roles
+
+		if err := db.users.saveUser(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &GraphQL{
+		state:   state,
+		schema:  graphql.MustParseSchema(sdl, &Query{}),
+		loaders: newLoaderCollection(),
+		guard:   newDirectiveGuard(sdl, config),
+		queries: &PersistedQueries{store: &MemoryQueryStore{items: newLRU(10, 0)}, manifest: map[string]string{}},
+	}
+}
+
+func (self *GraphQL) testExec(viewer string, query string) (string, string) {
+	ctx := withState(self.loaders.attach(context.Background()), self.state)
+
+	if viewer != "" {
+		ctx = withViewer(ctx, &Viewer{ID: viewer, Authorized: true})
+	}
+
+	response, _ := self.execute(ctx, &graphqlRequest{Query: query})
+	data, _ := json.Marshal(response.Data)
+
+	if len(response.Errors) == 0 {
+		return string(data), ""
+	}
+
+	code, _ := response.Errors[0].Extensions["code"].(string)
+
+	if code == "" {
+		code = response.Errors[0].Message
+	}
+
+	return string(data), code
+}
+
+var testID = regexp.MustCompile(`"id":"([^"]+)"`)
+
+func TestSchema(t *testing.T) {
+	for name, open := range testDatabases {
+		t.Run(name, func(t *testing.T) {
+			config := newTestConfig(t)
+			db := open(config)
+			defer db.close()
+
+			testSchema(t, newTestGraphQL(t, config, db))
+		})
+	}
+}
+
+// Steps run in order on the same store, each one builds on the last. The
+// first ID a step returns is saved under its saves name, $name in later
+// steps is replaced by it
+func testSchema(t *testing.T, g *GraphQL) {
+	var (
+		ids   = []string{}
+		steps = []struct {
+			name   string
+			viewer string
+			query  string
+			saves  string
+			want   []string
+			code   string
+		}{
+			{
+				name:   "create a project",
+				viewer: "owner",
+				query:  `mutation { newProject(link: "l", github: "g", description: "d", flags: "f", picture: "p", team: ["voter"], theme: 1) { id owner { id } team { id } } }`,
+				saves:  "project",
+				want:   []string{`"owner":{"id":"owner"}`, `"team":[{"id":"voter"}]`},
+			},
+			{
+				name:  "anonymous can't vote",
+				query: `mutation { updateRaiting(projectID: "$project", design: 4, performance: 4, easeOfUse: 4, responsiveness: 4, motion: 4) { id } }`,
+				code:  "UNAUTHENTICATED",
+			},
+			{
+				name:   "vote",
+				viewer: "voter",
+				query:  `mutation { updateRaiting(projectID: "$project", design: 4, performance: 2, easeOfUse: 4, responsiveness: 4, motion: 4) { id design performance } }`,
+				saves:  "vote",
+				want:   []string{`"design":100`, `"performance":50`},
+			},
+			{
+				name:   "participants can't judge",
+				viewer: "voter",
+				query:  `mutation { updateJudgeRaiting(projectID: "$project", design: 4, performance: 4, easeOfUse: 4, responsiveness: 4, motion: 4) { id } }`,
+				code:   "FORBIDDEN",
+			},
+			{
+				name:   "judge",
+				viewer: "judge",
+				query:  `mutation { updateJudgeRaiting(projectID: "$project", design: 2, performance: 2, easeOfUse: 2, responsiveness: 2, motion: 2, feedback: "ok") { id feedback judge { id } } }`,
+				saves:  "score",
+				want:   []string{`"feedback":"ok"`, `"judge":{"id":"judge"}`},
+			},
+			{
+				name:   "judge revises the score",
+				viewer: "judge",
+				query:  `mutation { updateJudgeRaiting(projectID: "$project", design: 4, performance: 4, easeOfUse: 4, responsiveness: 4, motion: 4, feedback: "great") { id feedback } }`,
+				want:   []string{`"id":"$score"`, `"feedback":"great"`},
+			},
+			{
+				name:   "comment",
+				viewer: "voter",
+				query:  `mutation { addComment(projectID: "$project", body: "nice") { id body author { id } } }`,
+				want:   []string{`"body":"nice"`, `"author":{"id":"voter"}`},
+			},
+			{
+				name:  "averages",
+				query: `{ project(id: "$project") { raiting judgeRaiting raitings { id } comments { body } } }`,
+				want:  []string{`"raiting":[100,50,100,100,100]`, `"judgeRaiting":[100,100,100,100,100]`, `"raitings":[{"id":"$vote"}]`, `"comments":[{"body":"nice"}]`},
+			},
+			{
+				name:   "feedback is for the owner",
+				viewer: "owner",
+				query:  `{ project(id: "$project") { judgeRaitings { feedback project { id } } } }`,
+				want:   []string{`"judgeRaitings":[{"feedback":"great","project":{"id":"$project"}}]`},
+			},
+			{
+				name:   "and hidden from voters",
+				viewer: "voter",
+				query:  `{ project(id: "$project") { judgeRaitings { feedback } } }`,
+				want:   []string{`"judgeRaitings":[]`},
+			},
+			{
+				name:   "moderation is for admins",
+				viewer: "judge",
+				query:  `mutation { hideProject(id: "$project") { id } }`,
+				code:   "FORBIDDEN",
+			},
+			{
+				name:   "void a vote",
+				viewer: "admin",
+				query:  `mutation { voidRaiting(id: "$vote", reason: "spam") { id voided } }`,
+				want:   []string{`"voided":true`},
+			},
+			{
+				name:   "void it twice",
+				viewer: "admin",
+				query:  `mutation { voidRaiting(id: "$vote") { id } }`,
+				code:   "Raiting $vote is already voided",
+			},
+			{
+				name:  "voided votes leave the averages",
+				query: `{ project(id: "$project") { raiting } }`,
+				want:  []string{`"raiting":[0,0,0,0,0]`},
+			},
+			{
+				name:   "hide the project",
+				viewer: "admin",
+				query:  `mutation { hideProject(id: "$project", reason: "nsfw") { id hidden } }`,
+				want:   []string{`"hidden":true`},
+			},
+			{
+				name:  "hidden from everyone",
+				query: `{ project(id: "$project") { id } projects { id } }`,
+				want:  []string{`"project":null`, `"projects":[]`},
+				code:  "NOT_FOUND",
+			},
+			{
+				name:   "judges can't score it",
+				viewer: "judge",
+				query:  `mutation { updateJudgeRaiting(projectID: "$project", design: 0, performance: 0, easeOfUse: 0, responsiveness: 0, motion: 0) { id } }`,
+				want:   []string{`"updateJudgeRaiting":null`},
+			},
+			{
+				name:   "but its owner",
+				viewer: "owner",
+				query:  `{ project(id: "$project") { id hidden } }`,
+				want:   []string{`"project":{"id":"$project","hidden":true}`},
+			},
+			{
+				name:   "transfer the project",
+				viewer: "admin",
+				query:  `mutation { transferProject(id: "$project", ownerID: "heir") { owner { id } } }`,
+				want:   []string{`"owner":{"id":"heir"}`},
+			},
+			{
+				name:   "to a user that doesn't exist",
+				viewer: "admin",
+				query:  `mutation { transferProject(id: "$project", ownerID: "ghost") { id } }`,
+				code:   "User ghost does not exist",
+			},
+			{
+				name:   "the old owner lost it",
+				viewer: "owner",
+				query:  `{ user(id: "owner") { project { id } } project(id: "$project") { id } }`,
+				want:   []string{`"user":{"project":null}`, `"project":null`},
+				code:   "NOT_FOUND",
+			},
+			{
+				name:   "the new owner has it",
+				viewer: "heir",
+				query:  `{ user(id: "heir") { project { id } } }`,
+				want:   []string{`"user":{"project":{"id":"$project"}}`},
+			},
+			{
+				name:   "ban a user",
+				viewer: "admin",
+				query:  `mutation { banUser(id: "voter", reason: "fraud") { id banned } }`,
+				want:   []string{`"banned":true`},
+			},
+			{
+				name:   "banned users lose their roles",
+				viewer: "voter",
+				query:  `mutation { addComment(projectID: "$project", body: "again") { id } }`,
+				code:   "FORBIDDEN",
+			},
+			{
+				name:   "moderation log",
+				viewer: "admin",
+				query:  `{ moderationLog { action targetType targetID reason moderator { id } } }`,
+				want: []string{
+					`{"action":"BAN_USER","targetType":"User","targetID":"voter","reason":"fraud","moderator":{"id":"admin"}}`,
+					`"action":"TRANSFER_PROJECT"`,
+					`"action":"HIDE_PROJECT"`,
+					`{"action":"VOID_RAITING","targetType":"Raiting","targetID":"$vote","reason":"spam","moderator":{"id":"admin"}}]`,
+				},
+			},
+			{
+				name:   "moderation log pages",
+				viewer: "admin",
+				query:  `{ moderationLog(limit: 1, offset: 1) { action } }`,
+				want:   []string{`"moderationLog":[{"action":"TRANSFER_PROJECT"}]`},
+			},
+			{
+				name:   "failed actions leave no trace",
+				viewer: "admin",
+				query:  `{ moderationLog(limit: 200) { action } }`,
+				want:   []string{`"moderationLog":[{"action":"BAN_USER"},{"action":"TRANSFER_PROJECT"},{"action":"HIDE_PROJECT"},{"action":"VOID_RAITING"}]`},
+			},
+		}
+	)
+
+	for _, step := range steps {
+		var (
+			replacer    = strings.NewReplacer(ids...)
+			data, code  = g.testExec(step.viewer, replacer.Replace(step.query))
+			expectedErr = replacer.Replace(step.code)
+		)
+
+		if code != expectedErr {
+			t.Fatalf("%s: got error %q, expected %q, data %s", step.name, code, expectedErr, data)
+		}
+
+		for _, want := range step.want {
+			if want = replacer.Replace(want); !strings.Contains(data, want) {
+				t.Fatalf("%s: %s doesn't contain %s", step.name, data, want)
+			}
+		}
+
+		if step.saves != "" {
+			if match := testID.FindStringSubmatch(data); match != nil {
+				ids = append(ids, "$"+step.saves, match[1])
+			}
+		}
+	}
+}
+
+// Serves one HTTP request the way the /graphql route would, as anonymous
+func (self *GraphQL) testServe(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	self.serve(w, r.WithContext(withState(r.Context(), self.state)))
+	return w
+}
+
+func testGet(query string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, "/graphql?"+url.Values{"query": {query}}.Encode(), nil)
+}
+
+func testPost(contentType string, accept string, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Accept", accept)
+	return r
+}
+
+func TestServeStatus(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxBodySize = 256
+
+	var (
+		db = newMemoryDatabase(config)
+		g  = newTestGraphQL(t, config, db)
+	)
+
+	for _, test := range []struct {
+		name        string
+		request     *http.Request
+		status      int
+		contentType string
+	}{
+		{"GET query", testGet(`{ users { id } }`), http.StatusOK, "application/json"},
+		{"GET mutation", testGet(`mutation { banUser(id: "voter") { id } }`), http.StatusMethodNotAllowed, "application/json"},
+		{"GET with broken variables", httptest.NewRequest(http.MethodGet, "/graphql?query=%7B%7D&variables=%7B", nil), http.StatusBadRequest, "text/plain; charset=utf-8"},
+		{"PUT", httptest.NewRequest(http.MethodPut, "/graphql", nil), http.StatusMethodNotAllowed, "text/plain; charset=utf-8"},
+		{"plain text body", testPost("text/plain", "", `{ users { id } }`), http.StatusUnsupportedMediaType, "text/plain; charset=utf-8"},
+		{"body over max_body_size", testPost("application/json", "", `{"query": "`+strings.Repeat(" ", 256)+`{ users { id } }"}`), http.StatusRequestEntityTooLarge, "text/plain; charset=utf-8"},
+		{"broken JSON", testPost("application/json", "", `{"query": `), http.StatusBadRequest, "text/plain; charset=utf-8"},
+		{"application/graphql body", testPost("application/graphql", "", `{ users { id } }`), http.StatusOK, "application/json"},
+		{"legacy client, unauthenticated", testPost("application/json", "application/json", `{"query": "{ suspiciousVotes { flags } }"}`), http.StatusOK, "application/json"},
+		{"unauthenticated", testPost("application/json", graphqlResponseType, `{"query": "{ suspiciousVotes { flags } }"}`), http.StatusUnauthorized, graphqlResponseType},
+		{"syntax error", testPost("application/json", graphqlResponseType, `{"query": "{ users {"}`), http.StatusBadRequest, graphqlResponseType},
+		{"partial data", testPost("application/json", graphqlResponseType, `{"query": "{ project(id: \"404\") { id } users { id } }"}`), http.StatusOK, graphqlResponseType},
+	} {
+		w := g.testServe(test.request)
+
+		if w.Code != test.status || w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s: got %d %s, expected %d %s, body %s", test.name, w.Code, w.Header().Get("Content-Type"), test.status, test.contentType, w.Body)
+		}
+
+		if test.status == http.StatusMethodNotAllowed && test.request.Method != http.MethodGet && w.Header().Get("Allow") != "GET, POST" {
+			t.Errorf("%s: Allow is %q", test.name, w.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestServeETag(t *testing.T) {
+	var (
+		config = newTestConfig(t)
+		db     = newMemoryDatabase(config)
+		g      = newTestGraphQL(t, config, db)
+		query  = `{ users { id } }`
+	)
+
+	first := g.testServe(testGet(query))
+	etag := first.Header().Get("ETag")
+
+	if etag == "" || first.Header().Get("Cache-Control") != "public, no-cache" {
+		t.Fatalf("expected an ETag and public caching, got %v", first.Header())
+	}
+
+	revalidate := testGet(query)
+	revalidate.Header.Set("If-None-Match", `"other", `+etag)
+
+	if w := g.testServe(revalidate); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected a 304 without a body, got %d %s", w.Code, w.Body)
+	}
+
+	// A write changes the response and so the tag
+	db.createUser(&DiscordUser{ID: "newcomer", Username: "newcomer"})
+
+	if w := g.testServe(revalidate); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected a fresh response after a write, got %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+
+	mutation := g.testServe(testPost("application/json", "", `{"query": "mutation { banUser(id: \"voter\") { id } }"}`))
+
+	if mutation.Header().Get("ETag") != "" || mutation.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("mutations must not be cached, got %v", mutation.Header())
+	}
+}
+
+func TestServeBatch(t *testing.T) {
+	config := newTestConfig(t)
+	config.MaxBatchSize = 2
+	config.MaxQueryCost = 300
+
+	var (
+		db = newMemoryDatabase(config)
+		g  = newTestGraphQL(t, config, db)
+	)
+
+	for _, test := range []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{
+			name:   "responses keep the order of the requests",
+			body:   `[{"query": "{ user(id: \"owner\") { id } }"}, {"query": "{ user(id: \"judge\") { id } }"}]`,
+			status: http.StatusOK,
+			want:   `[{"data":{"user":{"id":"owner"}},`,
+		},
+		{
+			name:   "one failing operation",
+			body:   `[{"query": "{ nothing }"}, {"query": "{ user(id: \"judge\") { id } }"}]`,
+			status: http.StatusOK,
+			want:   `{"data":{"user":{"id":"judge"}}`,
+		},
+		{
+			name:   "over max_batch_size",
+			body:   `[{"query": "{ users { id } }"}, {"query": "{ users { id } }"}, {"query": "{ users { id } }"}]`,
+			status: http.StatusBadRequest,
+			want:   "Batch of 3 operations exceeds the limit of 2",
+		},
+		{
+			name:   "max_cost bounds the whole batch",
+			body:   `[{"query": "{ users { project { id } } }"}, {"query": "{ users { project { id } } }"}]`,
+			status: http.StatusBadRequest,
+			want:   "Batch cost 402 exceeds the budget of 300",
+		},
+	} {
+		w := g.testServe(testPost("application/json", "", test.body))
+
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s: got %d %s, expected %d with %s", test.name, w.Code, w.Body, test.status, test.want)
+		}
+	}
+}
+
+// Responses are served from the cache until a write purges it
+func TestServeResponseCache(t *testing.T) {
+	var (
+		config = newTestConfig(t)
+		db     = newMemoryDatabase(config)
+		g      = newTestGraphQL(t, config, db)
+		query  = `{ users { id } }`
+	)
+
+	g.cache = newMemoryResponseCache(10)
+	db.cache = g.cache
+
+	first := g.testServe(testGet(query)).Body.String()
+
+	// Behind the back of the cache
+	if err := db.users.saveUser(&User{ID: "sneaky"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cached := g.testServe(testGet(query)).Body.String(); cached != first {
+		t.Fatalf("expected the cached response %s, got %s", first, cached)
+	}
+
+	// Cached per query, not per URL
+	if w := g.testServe(testPost("application/json", "", `{"query": "{ users { id } }"}`)); w.Body.String() != first {
+		t.Fatalf("expected the cached response for the same query, got %s", w.Body)
+	}
+
+	// Sign ins wait out maxAge, Project writes purge
+	heir := db.createUser(&DiscordUser{ID: "heir"})
+
+	if _, err := db.createProject(heir, &Project{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if fresh := g.testServe(testGet(query)).Body.String(); !strings.Contains(fresh, `"sneaky"`) {
+		t.Fatalf("the write didn't purge the cache, got %s", fresh)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	healthUp   = "up"
+	healthDown = "down"
+)
+
+// Liveness only says the process is serving, readiness checks everything a
+// request needs, so traffic stops while any of it is missing
+type Health struct {
+	state *State
+}
+
+type HealthReport struct {
+	Status     string                      `json:"status"`
+	Components map[string]*ComponentHealth `json:"components,omitempty"`
+}
+
+// Error is a fixed description, raw errors and internals go into Details,
+// which only admins get to see unless health.details is set
+type ComponentHealth struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func newHealth(state *State) *Health {
+	return &Health{state}
+}
+
+// /healthz
+func (self *Health) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, "application/json", http.StatusOK, &HealthReport{Status: healthUp})
+}
+
+// /readyz
+func (self *Health) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		report = &HealthReport{
+			Status: healthUp,
+			Components: map[string]*ComponentHealth{
+				"database":   self.database(r),
+				"migrations": self.migrations(),
+				"oauth":      self.oauth(),
+			},
+		}
+		statusCode = http.StatusOK
+	)
+
+	details := self.showDetails(r)
+
+	for _, component := range report.Components {
+		if component.Status != healthUp {
+			report.Status = healthDown
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		if !details {
+			component.Details = nil
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, "application/json", statusCode, report)
+}
+
+func (self *Health) database(r *http.Request) *ComponentHealth {
+	status := self.state.db.status(r.Context())
+	health := &ComponentHealth{Status: healthUp, Details: status}
+
+	if !status.Up {
+		health.Status = healthDown
+		health.Error = "Database unreachable"
+	}
+
+	return health
+}
+
+func (self *Health) migrations() *ComponentHealth {
+	if err := self.state.db.migrationError(); err != nil {
+		return &ComponentHealth{
+			Status:  healthDown,
+			Error:   "Migration failed",
+			Details: map[string]string{"error": err.Error()},
+		}
+	}
+
+	return &ComponentHealth{Status: healthUp}
+}
+
+// Logins can't complete without these, their values are never reported
+func (self *Health) oauth() *ComponentHealth {
+	var (
+		config  = self.state.config
+		missing []string
+	)
+
+	for key, value := range map[string]string{
+		"discord.client_id":     config.DiscordClientID,
+		"discord.client_secret": config.DiscordClientSecret,
+		"jwt.secret":            config.JwtSecret,
+	} {
+		if value == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+
+		return &ComponentHealth{
+			Status:  healthDown,
+			Error:   "Missing config",
+			Details: map[string][]string{"missing": missing},
+		}
+	}
+
+	return &ComponentHealth{Status: healthUp}
+}
+
+// The readiness probe is unauthenticated, so details are for ADMIN users
+// only, unless health.details shows them to everyone
+func (self *Health) showDetails(r *http.Request) bool {
+	if self.state.config.HealthDetails {
+		return true
+	}
+
+	viewer := viewerFrom(r.Context())
+
+	if !viewer.Authorized {
+		return false
+	}
+
+	users, err := self.state.db.withContext(r.Context()).users.findUsers([]string{viewer.ID})
+	return err == nil && len(users) == 1 && users[0].hasRole(RoleAdmin)
+}
+
+func (self *Health) registerRoutes(router *mux.Router) {
+	router.HandleFunc("/healthz", self.livenessHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/readyz", self.readinessHandler).Methods(http.MethodGet, http.MethodHead)
+}
@@ -1,17 +1,16 @@
 package main
 
 import (
-	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
 type JwtProvider struct {
-	secret string
+	secret  string
+	cookies bool // Accept the session from an HttpOnly cookie
+	secure  bool // Only send session cookies over https
 }
 
 func (self *JwtProvider) createToken(auth *DiscordAuth) (*string, error) {
@@ -55,26 +54,31 @@ func (self *JwtProvider) middleware(next http.Handler) http.Handler {
 			ctx        = r.Context()
 		)
 
-		auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+		raw, fromCookie := self.sessionToken(r)
 
-		// TODO: Handle expiration
-		if len(auth) == 2 || auth[0] == "Bearer" {
-			if token, err := self.validateToken(&auth[1]); err == nil {
+		if raw != "" {
+			if token, err := self.validateToken(&raw); err == nil {
 				if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 					if userID, ok := claims["jti"].(string); ok {
 						authorized = true
 						id = userID
 					}
 				} else {
-					log.Printf("Could not parse claims: %s\n", claims)
+					loggerFrom(ctx).Warn("Could not parse session claims")
 				}
 			} else {
-				log.Println(err)
+				loggerFrom(ctx).Debug("Invalid session", "error", err)
 			}
 		}
 
-		ctx = context.WithValue(ctx, "authorized", authorized)
-		ctx = context.WithValue(ctx, "user_id", id)
+		// Browsers attach the cookie on their own, so a cookie session only
+		// counts when the request also proves it can read the CSRF cookie
+		if authorized && fromCookie && !validCSRF(r) {
+			authorized = false
+			id = ""
+		}
+
+		ctx = withViewer(ctx, &Viewer{ID: id, Authorized: authorized})
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -3,7 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"reflect"
+	"sync"
 
 	"gopkg.in/nicksrandall/dataloader.v5"
 )
@@ -14,29 +15,53 @@ const (
 	userLoaderKey    key = "user"
 	projectLoaderKey key = "project"
 	raitingLoaderKey key = "raiting"
+
+	raitingsByProjectLoaderKey key = "raitingsByProject"
+	raitingsByOwnerLoaderKey   key = "raitingsByOwner"
+	projectsByOwnerLoaderKey   key = "projectsByOwner"
+	commentsByProjectLoaderKey key = "commentsByProject"
+
+	judgeRaitingsByProjectLoaderKey key = "judgeRaitingsByProject"
 )
 
 type LoaderCollection struct {
 	dataloaderFuncMap map[key]dataloader.BatchFunc
 }
 
+// Every batch loader, adding an entity is one more line here
+var entityLoaders = map[key]*EntityLoader{
+	userLoaderKey:    byID("User", usersByID),
+	projectLoaderKey: byID("Project", projectsByID),
+	raitingLoaderKey: byID("Raiting", raitingsByID),
+
+	raitingsByProjectLoaderKey: byForeignKey("Raiting", raitingsByProject, "ProjectID"),
+	raitingsByOwnerLoaderKey:   byForeignKey("Raiting", raitingsByOwner, "OwnerID"),
+	projectsByOwnerLoaderKey:   byForeignKey("Project", projectsByOwner, "OwnerID"),
+	commentsByProjectLoaderKey: byForeignKey("Comment", commentsByProject, "ProjectID"),
+
+	judgeRaitingsByProjectLoaderKey: byForeignKey("JudgeRaiting", judgeRaitingsByProject, "ProjectID"),
+}
+
 func newLoaderCollection() LoaderCollection {
-	userLoader := &UserLoader{}
-	projectLoader := &ProjectLoader{}
-	raitingLoader := &RaitingLoader{}
-
-	return LoaderCollection{
-		dataloaderFuncMap: map[key]dataloader.BatchFunc{
-			userLoaderKey:    userLoader.loadBatch,
-			projectLoaderKey: projectLoader.loadBatch,
-			raitingLoaderKey: raitingLoader.loadBatch,
-		},
+	funcs := make(map[key]dataloader.BatchFunc, len(entityLoaders))
+
+	for key, loader := range entityLoaders {
+		if loader.shared {
+			funcs[key] = traceBatch(key, observeBatch(key, sharedCache(key, loader.loadBatch)))
+		} else {
+			funcs[key] = traceBatch(key, observeBatch(key, loader.loadBatch))
+		}
 	}
+
+	return LoaderCollection{dataloaderFuncMap: funcs}
 }
 
 func (self *LoaderCollection) attach(ctx context.Context) context.Context {
 	for key, batchFunc := range self.dataloaderFuncMap {
-		ctx = context.WithValue(ctx, key, dataloader.NewBatchedLoader(batchFunc))
+		ctx = context.WithValue(ctx, key, dataloader.NewBatchedLoader(
+			batchFunc,
+			dataloader.WithCache(newObservedCache(key)),
+		))
 	}
 
 	return ctx
@@ -54,221 +79,297 @@ func loadSomething(ctx context.Context, key string, loader key) (interface{}, er
 	ldr, err := extract(ctx, loader)
 
 	if err != nil {
-		log.Println(err)
+		loggerFrom(ctx).Error("Loader missing from context", "error", err)
 		return nil, err
 	}
 
 	data := ldr.Load(ctx, dataloader.StringKey(key))
 	res, err := data()
 
+	// Batch failures were logged by the loader already
 	if err != nil {
-		log.Println(err)
+		loggerFrom(ctx).Debug("Load failed", "loader", loader, "key", key, "error", err)
 		return nil, err
 	}
 
+	touch(ctx, res)
 	return res, nil
 }
 
-// TODO: Is this worth it?
-// func mapItems(items interface{}) *map[string]interface{} {
-// 	mapped := make(map[string]interface{})
-// 	ref := reflect.ValueOf(items)
-
-// 	for i := 0; i < ref.Len(); i++ {
-// 		item := ref.Index(i)
-// 		mapped[item.Elem().Field(0).String()] = item.Elem().Interface()
-// 	}
-
-// 	return &mapped
-// }
-
-// User loader
-//------------------------------------------------------------------------------
+// Loads the keys concurrently, so they end up in the same batch. Keys that
+// failed to load are left out
+func loadMany(ctx context.Context, keys []string, loader key) []interface{} {
+	ldr, err := extract(ctx, loader)
 
-type UserLoader struct{}
+	if err != nil {
+		loggerFrom(ctx).Error("Loader missing from context", "error", err)
+		return nil
+	}
 
-func (self *UserLoader) loadBatch(
-	ctx context.Context,
-	keys dataloader.Keys,
-) []*dataloader.Result {
 	var (
-		n       = len(keys)
-		results = make([]*dataloader.Result, n)
-		ids     = make([]string, n)
-		db      = ctx.Value("state").(*State).db
+		data, errs = ldr.LoadMany(ctx, dataloader.NewKeysFromStrings(keys))()
+		items      = make([]interface{}, 0, len(data))
 	)
 
-	log.Printf("Fetching %s from UserLoader\n", keys)
+	for i, item := range data {
+		if errs != nil && errs[i] != nil {
+			loggerFrom(ctx).Debug("Load failed", "loader", loader, "key", keys[i], "error", errs[i])
+			continue
+		}
 
-	// Cheaper version, if only 1 key
-	if n == 1 {
-		var user User
+		touch(ctx, item)
+		items = append(items, item)
+	}
 
-		if _, err := db.findID(&user, keys[0].String()); err == nil {
-			results[0] = &dataloader.Result{Data: user, Error: nil}
-		} else {
-			results[0] = &dataloader.Result{Data: nil, Error: nil}
-		}
+	return items
+}
 
-		return results
+// Shared cache
+//------------------------------------------------------------------------------
+
+// Second level cache shared by every request, behind the request scoped
+// loaders. Database forgets rows as it writes them, here and on the other
+// instances when events.bus is postgres, the TTL bounds how long they may
+// serve a stale row otherwise. A nil cache is disabled
+type LoaderCache struct {
+	sync.Mutex
+	items   *LRU
+	forgets uint64 // The generation
+}
+
+func newLoaderCache(config *Config) *LoaderCache {
+	if config.LoaderCacheSize <= 0 {
+		return nil
 	}
 
-	for i, key := range keys {
-		ids[i] = key.String()
+	return &LoaderCache{items: newLRU(config.LoaderCacheSize, config.LoaderCacheTTL)}
+}
+
+// Taken before a batch runs and handed back to set
+func (self *LoaderCache) generation() uint64 {
+	if self == nil {
+		return 0
 	}
 
-	var users Users
-	_, err := db.findWithID(&users, ids)
+	self.Lock()
+	defer self.Unlock()
 
-	if err != nil {
-		for i := 0; i < n; i++ {
-			results[i] = &dataloader.Result{Data: nil, Error: nil}
-		}
+	return self.forgets
+}
 
-		return results
+func (self *LoaderCache) get(loader key, id string) (interface{}, bool) {
+	if self == nil {
+		return nil, false
 	}
 
-	mapped := make(map[string]*User)
+	return self.items.get(string(loader) + ":" + id)
+}
 
-	for _, user := range users {
-		mapped[user.ID] = user
+// Dropped when anything was forgotten since generation was taken, the batch
+// may have read the row before that write
+func (self *LoaderCache) set(loader key, id string, value interface{}, generation uint64) {
+	if self == nil {
+		return
 	}
 
-	for i, id := range ids {
-		if mapped[id] != nil {
-			results[i] = &dataloader.Result{Data: *mapped[id], Error: nil}
-		} else {
-			results[i] = &dataloader.Result{Data: nil, Error: fmt.Errorf("user %s not found", id)}
-		}
-	}
+	self.Lock()
+	defer self.Unlock()
 
-	return results
+	if generation == self.forgets {
+		self.items.set(string(loader)+":"+id, value)
+	}
 }
 
-// Project loader
-//------------------------------------------------------------------------------
+func (self *LoaderCache) forget(loader key, ids ...string) {
+	if self == nil {
+		return
+	}
 
-type ProjectLoader struct{}
+	self.Lock()
+	defer self.Unlock()
 
-func (self *ProjectLoader) loadBatch(
-	ctx context.Context,
-	keys dataloader.Keys,
-) []*dataloader.Result {
-	var (
-		n       = len(keys)
-		results = make([]*dataloader.Result, n)
-		ids     = make([]string, n)
-		db      = ctx.Value("state").(*State).db
-	)
+	self.forgets++
 
-	log.Printf("Fetching %s from ProjectLoader\n", keys)
+	for _, id := range ids {
+		self.items.remove(string(loader) + ":" + id)
+	}
+}
 
-	// Cheaper version, if only 1 key
-	if n == 1 {
-		var project Project
+// Serves what it can from the shared cache and only hands the misses to
+// the batch function, whose results are cached for the next request
+func sharedCache(loader key, batch dataloader.BatchFunc) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		db := dbFrom(ctx)
 
-		if _, err := db.findID(&project, keys[0].String()); err == nil {
-			results[0] = &dataloader.Result{Data: project, Error: nil}
-		} else {
-			results[0] = &dataloader.Result{Data: nil, Error: nil}
+		if db == nil || db.loaderCache == nil {
+			return batch(ctx, keys)
 		}
 
-		return results
-	}
+		var (
+			results    = make([]*dataloader.Result, len(keys))
+			generation = db.loaderCache.generation()
+			missing    dataloader.Keys
+			positions  []int
+		)
+
+		for i, key := range keys {
+			value, ok := db.loaderCache.get(loader, key.String())
+			observeCacheLookup(loader, "shared", ok)
+
+			if ok {
+				results[i] = &dataloader.Result{Data: value, Error: nil}
+			} else {
+				missing = append(missing, key)
+				positions = append(positions, i)
+			}
+		}
 
-	for i, key := range keys {
-		ids[i] = key.String()
-	}
+		if len(missing) == 0 {
+			return results
+		}
 
-	var items Projects
-	_, err := db.findWithID(&items, ids)
+		for i, result := range batch(ctx, missing) {
+			results[positions[i]] = result
 
-	if err != nil {
-		for i := 0; i < n; i++ {
-			results[i] = &dataloader.Result{Data: nil, Error: nil}
+			if result != nil && result.Error == nil && result.Data != nil {
+				db.loaderCache.set(loader, missing[i].String(), result.Data, generation)
+			}
 		}
 
 		return results
 	}
+}
 
-	mapped := make(map[string]*Project)
+// Entity loader
+//------------------------------------------------------------------------------
 
-	for _, item := range items {
-		mapped[item.String()] = item
-	}
+// Returned for keys without a row, surfaces in GraphQL with code NOT_FOUND
+type NotFoundError struct {
+	Entity string
+	ID     string
+}
 
-	for i, id := range ids {
-		if mapped[id] != nil {
-			project := mapped[id]
+func (self *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %s not found", self.Entity, self.ID)
+}
 
-			results[i] = &dataloader.Result{Data: *project, Error: nil}
-		} else {
-			results[i] = &dataloader.Result{Data: nil, Error: fmt.Errorf("project %s not found", id)}
-		}
-	}
+func (self *NotFoundError) Extensions() map[string]interface{} {
+	return map[string]interface{}{"code": "NOT_FOUND"}
+}
 
-	return results
+// Batch loads one kind of entity. query fetches the rows for a set of keys
+// as a slice, key tells which key a row belongs to
+type EntityLoader struct {
+	name   string
+	query  func(db *Database, keys []string) (interface{}, error)
+	key    func(entity interface{}) string
+	many   bool // Every key gets a slice of the rows matching it
+	shared bool // Kept in the LoaderCache between requests
 }
 
-// Raiting loader
-//------------------------------------------------------------------------------
+// Loads rows by primary key, query returns a slice of entity pointers
+func byID(name string, query func(db *Database, ids []string) (interface{}, error)) *EntityLoader {
+	return &EntityLoader{
+		name:   name,
+		query:  query,
+		key:    fieldKey("ID"),
+		shared: true,
+	}
+}
 
-type RaitingLoader struct{}
+// Loads rows by the foreign key in field, for one-to-many edges. Keys
+// without rows get an empty slice, not a NotFoundError
+func byForeignKey(
+	name string,
+	query func(db *Database, keys []string) (interface{}, error),
+	field string,
+) *EntityLoader {
+	return &EntityLoader{
+		name:  name,
+		query: query,
+		key:   fieldKey(field),
+		many:  true,
+	}
+}
+
+func fieldKey(field string) func(entity interface{}) string {
+	return func(entity interface{}) string {
+		return fmt.Sprint(reflect.ValueOf(entity).FieldByName(field).Interface())
+	}
+}
 
-func (self *RaitingLoader) loadBatch(
+// Results hold entities by value, as resolvers expect them. A failed query
+// fails every key, keys without a row get a NotFoundError
+func (self *EntityLoader) loadBatch(
 	ctx context.Context,
 	keys dataloader.Keys,
 ) []*dataloader.Result {
 	var (
-		n       = len(keys)
-		results = make([]*dataloader.Result, n)
-		ids     = make([]string, n)
-		db      = ctx.Value("state").(*State).db
+		ids     = keys.Keys()
+		results = make([]*dataloader.Result, len(ids))
 	)
 
-	log.Printf("Fetching %s from RaitingLoader\n", keys)
+	loggerFrom(ctx).Debug("Fetching from loader", "loader", self.name, "keys", ids)
+	items, err := self.query(dbFrom(ctx), ids)
 
-	// Cheaper version, if only 1 key
-	if n == 1 {
-		var raiting Raiting
+	if err != nil {
+		loggerFrom(ctx).Error("Loader failed", "loader", self.name, "error", err)
 
-		if _, err := db.findID(&raiting, keys[0].String()); err == nil {
-			results[0] = &dataloader.Result{Data: raiting, Error: nil}
-		} else {
-			results[0] = &dataloader.Result{Data: nil, Error: nil}
+		for i := range results {
+			results[i] = &dataloader.Result{Data: nil, Error: err}
 		}
 
 		return results
 	}
 
-	for i, key := range keys {
-		ids[i] = key.String()
+	rows := reflect.ValueOf(items)
+
+	if self.many {
+		return self.group(ids, rows)
 	}
 
-	var items Raitings
-	_, err := db.findWithID(&items, ids)
+	mapped := make(map[string]interface{}, rows.Len())
 
-	if err != nil {
-		for i := 0; i < n; i++ {
-			results[i] = &dataloader.Result{Data: nil, Error: nil}
-		}
+	for i := 0; i < rows.Len(); i++ {
+		entity := reflect.Indirect(rows.Index(i)).Interface()
+		mapped[self.key(entity)] = entity
+	}
 
-		return results
+	for i, id := range ids {
+		if entity, ok := mapped[id]; ok {
+			results[i] = &dataloader.Result{Data: entity, Error: nil}
+		} else {
+			results[i] = &dataloader.Result{Data: nil, Error: &NotFoundError{self.name, id}}
+		}
 	}
 
-	mapped := make(map[string]*Raiting)
+	return results
+}
+
+// Slices hold entities by value, []Raiting for Raitings
+func (self *EntityLoader) group(ids []string, rows reflect.Value) []*dataloader.Result {
+	var (
+		results   = make([]*dataloader.Result, len(ids))
+		sliceType = reflect.SliceOf(rows.Type().Elem().Elem())
+		grouped   = make(map[string]reflect.Value, len(ids))
+	)
+
+	for i := 0; i < rows.Len(); i++ {
+		entity := reflect.Indirect(rows.Index(i))
+		key := self.key(entity.Interface())
 
-	for _, item := range items {
-		mapped[item.String()] = item
+		if _, ok := grouped[key]; !ok {
+			grouped[key] = reflect.MakeSlice(sliceType, 0, 1)
+		}
+
+		grouped[key] = reflect.Append(grouped[key], entity)
 	}
 
 	for i, id := range ids {
-		if mapped[id] != nil {
-			raiting := mapped[id]
-
-			results[i] = &dataloader.Result{Data: *raiting, Error: nil}
+		if items, ok := grouped[id]; ok {
+			results[i] = &dataloader.Result{Data: items.Interface(), Error: nil}
 		} else {
-			results[i] = &dataloader.Result{Data: nil, Error: fmt.Errorf("project %s not found", id)}
+			results[i] = &dataloader.Result{Data: reflect.MakeSlice(sliceType, 0, 0).Interface(), Error: nil}
 		}
 	}
 
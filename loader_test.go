@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/nicksrandall/dataloader.v5"
+)
+
+func newTestLoaderCache() *LoaderCache {
+	return newLoaderCache(&Config{LoaderCacheSize: 10, LoaderCacheTTL: time.Minute})
+}
+
+// A row written while a batch runs may have been read before the write
+func TestSharedCacheForgetDuringBatch(t *testing.T) {
+	var (
+		db    = &Database{loaderCache: newTestLoaderCache()}
+		ctx   = withState(context.Background(), &State{db: db})
+		calls int
+	)
+
+	load := sharedCache(userLoaderKey, func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		calls++
+
+		if calls == 1 {
+			db.loaderCache.forget(userLoaderKey, "a")
+		}
+
+		return []*dataloader.Result{{Data: User{ID: "a"}}}
+	})
+
+	load(ctx, dataloader.NewKeysFromStrings([]string{"a"}))
+
+	if _, ok := db.loaderCache.get(userLoaderKey, "a"); ok {
+		t.Fatal("a row read before it was forgotten got cached")
+	}
+
+	load(ctx, dataloader.NewKeysFromStrings([]string{"a"}))
+
+	if _, ok := db.loaderCache.get(userLoaderKey, "a"); !ok {
+		t.Fatal("a row read after the write wasn't cached")
+	}
+}
+
+// Writes on other instances arrive as events and forget the row here too
+func TestSharedCacheRemoteForget(t *testing.T) {
+	db := newMemoryDatabase(newTestConfig(t))
+	db.loaderCache = newTestLoaderCache()
+
+	for _, loader := range []key{userLoaderKey, projectLoaderKey} {
+		db.loaderCache.set(loader, "1", "row", db.loaderCache.generation())
+	}
+
+	db.evict(topicCacheForget, "user:1")
+
+	if _, ok := db.loaderCache.get(userLoaderKey, "1"); ok {
+		t.Error("the remote write wasn't forgotten")
+	}
+
+	if _, ok := db.loaderCache.get(projectLoaderKey, "1"); !ok {
+		t.Error("a row of another loader was forgotten")
+	}
+}
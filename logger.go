@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Replaced by newLogger once the config is loaded, until then everything is
+// logged as JSON at info level
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{ReplaceAttr: redact}))
+
+const (
+	loggerContextKey contextKey = "logger"
+	requestIDHeader             = "X-Request-ID"
+)
+
+// Attribute keys containing any of these never have their value logged
+var redactedKeys = []string{"token", "email", "secret", "password", "authorization", "cookie"}
+
+// Client supplied request IDs are only kept when they look like one
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newLogger(config *Config) *slog.Logger {
+	var (
+		level   slog.Level
+		handler slog.Handler
+		options = &slog.HandlerOptions{Level: &level, ReplaceAttr: redact}
+	)
+
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		fatal("Unknown log.level, expected debug, info, warn or error", "level", config.LogLevel)
+	}
+
+	switch config.LogFormat {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		fatal("Unknown log.format, expected json or text", "format", config.LogFormat)
+	}
+
+	logger = slog.New(handler)
+
+	// Whatever still goes trough the standard log package, libraries
+	// included, ends up in the same stream
+	slog.SetDefault(logger)
+	return logger
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	key := strings.ToLower(attr.Key)
+
+	for _, redacted := range redactedKeys {
+		if strings.Contains(key, redacted) {
+			return slog.String(attr.Key, "[REDACTED]")
+		}
+	}
+
+	return attr
+}
+
+// Logs at error level and exits, for failures the server can't start with
+func fatal(msg string, args ...interface{}) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// Request scoped
+//------------------------------------------------------------------------------
+
+func withLogger(ctx context.Context, requestLogger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, requestLogger)
+}
+
+// Never returns nil, outside of a request this is the global logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if requestLogger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return requestLogger
+	}
+
+	return logger
+}
+
+// Keeps the ID a proxy in front of us assigned, or makes a new one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); requestIDPattern.MatchString(id) {
+		return id
+	}
+
+	id := make([]byte, 8)
+
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// Tags everything logged during the request with its ID and trace
+func withRequestLogger(r *http.Request, id string) (*http.Request, *slog.Logger) {
+	var (
+		ctx           = r.Context()
+		requestLogger = logger.With("request_id", id)
+	)
+
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		requestLogger = requestLogger.With("trace_id", span.TraceID().String())
+	}
+
+	return r.WithContext(withLogger(ctx, requestLogger)), requestLogger
+}
+
+// gorm
+//------------------------------------------------------------------------------
+
+// gorm logs errors itself and, in debug mode, every statement. Its values
+// come as source, then either a message or duration, SQL, vars and rows.
+// Vars are never logged, they carry whatever users sent
+type GormLogger struct {
+	logger *slog.Logger // nil logs to the global logger
+}
+
+func (self GormLogger) Print(values ...interface{}) {
+	if len(values) < 3 {
+		return
+	}
+
+	log := self.logger
+
+	if log == nil {
+		log = logger
+	}
+
+	switch values[0] {
+	case "sql":
+		if duration, ok := values[2].(time.Duration); ok && len(values) >= 4 {
+			log.Debug(
+				"SQL statement",
+				"source", values[1],
+				"duration_ms", float64(duration.Microseconds())/1000,
+				"statement", values[3],
+			)
+		}
+	case "error":
+		log.Error("Database error", "source", values[1], "error", fmt.Sprint(values[2:]...))
+	default:
+		log.Info(fmt.Sprint(values[2:]...), "source", values[1])
+	}
+}
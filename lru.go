@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Bounded cache with least recently used eviction. A zero ttl never expires
+type LRU struct {
+	sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	order *list.List
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (self *LRU) get(key string) (interface{}, bool) {
+	self.Lock()
+	defer self.Unlock()
+
+	element, ok := self.items[key]
+
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		self.removeElement(element)
+		return nil, false
+	}
+
+	self.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (self *LRU) set(key string, value interface{}) {
+	self.setTTL(key, value, self.ttl)
+}
+
+// Same as set, but overrides the caches default ttl for this entry
+func (self *LRU) setTTL(key string, value interface{}, ttl time.Duration) {
+	self.Lock()
+	defer self.Unlock()
+
+	var expires time.Time
+
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := self.items[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		self.order.MoveToFront(element)
+		return
+	}
+
+	self.items[key] = self.order.PushFront(&lruEntry{key, value, expires})
+
+	for self.size > 0 && self.order.Len() > self.size {
+		self.removeElement(self.order.Back())
+	}
+}
+
+func (self *LRU) remove(key string) {
+	self.Lock()
+	defer self.Unlock()
+
+	if element, ok := self.items[key]; ok {
+		self.removeElement(element)
+	}
+}
+
+func (self *LRU) clear() {
+	self.Lock()
+	defer self.Unlock()
+
+	self.items = make(map[string]*list.Element)
+	self.order.Init()
+}
+
+func (self *LRU) len() int {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.order.Len()
+}
+
+func (self *LRU) removeElement(element *list.Element) {
+	self.order.Remove(element)
+	delete(self.items, element.Value.(*lruEntry).key)
+}
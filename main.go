@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,22 +16,24 @@ import (
 )
 
 type State struct {
-	config *Config
-	jwt    *JwtProvider
-	db     *Database
+	config  *Config
+	jwt     *JwtProvider
+	db      *Database
+	events  EventBus
+	cors    *CORS
+	limiter *RateLimiter
 }
 
 func (self *State) withContext() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), "state", self)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r.WithContext(withState(r.Context(), self)))
 		})
 	}
 }
 
 var (
-	wait time.Duration
+	wait = time.Second * 15 // For in-flight requests to finish on shutdown
 )
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -39,23 +41,55 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	config := loadConfig(".")
+	configPath := flag.String("config", ".", "Config file, or the directory holding config.toml")
+	flag.Parse()
+
+	if args := flag.Args(); len(args) == 2 && args[0] == "config" && args[1] == "check" {
+		os.Exit(checkConfig(*configPath, os.Stdout, os.Stderr))
+	}
+
+	config, err := loadConfig(*configPath)
+
+	if err != nil {
+		fatal("Invalid config, run config check for details", "error", err)
+	}
+
+	newLogger(config)
+	shutdownTracing := newTracing(config)
+	db := newDB(config)
+	instrumentDB(db)
+	traceDB(db)
+	events := newEventBus(config, db)
+	cache := newResponseCache(config)
+	db.events = events
+	db.cache = cache
 
 	state := &State{
 		config: config,
-		jwt:    &JwtProvider{config.JwtState},
-		db:     newDB(config),
+		jwt:    &JwtProvider{config.JwtSecret, config.SessionCookie, config.SessionSecure},
+		db:     db,
+		events: events,
+		cors:   newCORS(config),
 	}
 
+	state.limiter = newRateLimiter(config, db)
+
+	go db.refreshFlags(config.FraudRefreshEvery)
+
 	discordOauth := newOauth(state)
+	health := newHealth(state)
+	rootSchema := schema.GetRootSchema()
 	graphQL := GraphQL{
 		state:   state,
-		schema:  graphql.MustParseSchema(schema.GetRootSchema(), &Query{}),
+		schema:  graphql.MustParseSchema(rootSchema, &Query{}, graphql.Tracer(GraphQLTracer{})),
 		loaders: newLoaderCollection(),
+		guard:   newDirectiveGuard(rootSchema, config),
+		queries: newPersistedQueries(config, db),
+		cache:   cache,
 	}
 
 	// Server setup
-	log.Println("Starting server…")
+	logger.Info("Starting server", "address", config.Address)
 
 	router := mux.NewRouter()
 	server := &http.Server{
@@ -66,10 +100,15 @@ func main() {
 		Handler:      router,
 	}
 
+	router.Use(tracingMiddleware)
+	router.Use(metricsMiddleware)
 	router.Use(loggingMiddleware)
-	router.Use(corsMiddleware) // FIXME: Remove this
+	router.Use(state.cors.middleware)
 	router.Use(state.withContext())
 	router.Use(state.jwt.middleware)
+	router.Use(state.limiter.middleware)
+
+	state.cors.registerRoutes(router)
 
 	fs := http.FileServer(http.Dir("../grip/build"))
 	static := http.FileServer(http.Dir("../grip/build/static"))
@@ -84,30 +123,42 @@ func main() {
 	jwtRoute.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		if authenticated, _ := ctx.Value("authorized").(bool); authenticated {
+		if viewerFrom(ctx).Authorized {
 			message := "Tested an authenticated user"
 
-			fmt.Println(message)
+			loggerFrom(ctx).Debug(message)
 			fmt.Fprintln(w, ctx)
 		} else {
 			message := "Tested user is not authenticated"
 
-			fmt.Println(message)
+			loggerFrom(ctx).Debug(message)
 			fmt.Fprintln(w, ctx)
 		}
 	})
 
+	health.registerRoutes(router)
+	registerMetricsRoutes(router, config)
 	discordOauth.registerRoutes(router)
 	graphQL.registerRoutes(router)
 
 	// Graceful shutdown
 	go func() {
-		if err := server.ListenAndServe(); err != nil {
-			log.Println(err)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("Server failed", "error", err)
 		}
 	}()
 
-	log.Println("Server started")
+	metricsServer := newMetricsServer(config)
+
+	if metricsServer != nil {
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Metrics server failed", "error", err)
+			}
+		}()
+	}
+
+	logger.Info("Server started")
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -120,6 +171,14 @@ func main() {
 
 	server.Shutdown(ctx)
 
-	log.Println("Shutting down…")
+	if metricsServer != nil {
+		metricsServer.Shutdown(ctx)
+	}
+
+	events.close()
+	db.close()
+	shutdownTracing(ctx)
+
+	logger.Info("Shutting down")
 	os.Exit(0)
 }
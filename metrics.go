@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/graph-gophers/graphql-go/errors"
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dataloader "gopkg.in/nicksrandall/dataloader.v5"
+)
+
+// Everything is registered on the default registry, which also carries the
+// Go runtime and process collectors
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grip_http_request_duration_seconds",
+		Help:    "HTTP requests by route template, method and status code",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	graphqlOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grip_graphql_operation_duration_seconds",
+		Help:    "GraphQL operations by operation name and type",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "type"})
+
+	graphqlErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grip_graphql_errors_total",
+		Help: "GraphQL errors by operation name and error code",
+	}, []string{"operation", "code"})
+
+	loaderBatchSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grip_dataloader_batch_size",
+		Help:    "Keys handed to a dataloader batch function",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200},
+	}, []string{"loader"})
+
+	loaderCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grip_dataloader_cache_requests_total",
+		Help: "Dataloader cache lookups, per request or shared between requests",
+	}, []string{"loader", "cache", "result"})
+
+	dbQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grip_db_query_duration_seconds",
+		Help:    "Database statements ran trough gorm, by operation and table",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+
+	dbQueryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grip_db_query_errors_total",
+		Help: "Failed database statements, missing rows aside",
+	}, []string{"operation", "table"})
+
+	votesCast = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grip_votes_cast_total",
+		Help: "Votes cast or changed by participants",
+	})
+
+	judgeScoresCast = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grip_judge_scores_total",
+		Help: "Scores given or changed by judges",
+	})
+
+	projectsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grip_projects_created_total",
+		Help: "Projects created",
+	})
+
+	commentsPosted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "grip_comments_posted_total",
+		Help: "Comments left on projects",
+	})
+
+	moderationActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grip_moderation_actions_total",
+		Help: "Committed moderation actions by action",
+	}, []string{"action"})
+
+	rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "grip_rate_limited_total",
+		Help: "Requests denied by the rate limiter, by operation",
+	}, []string{"operation"})
+)
+
+const dbStartedAtKey = "metrics:started_at"
+
+// HTTP
+//------------------------------------------------------------------------------
+
+// Routes are labeled by their template, so IDs in paths don't blow up the
+// label set. WebSocket connections aren't requests and are left out
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			sw    = &StatusWriter{ResponseWriter: w, StatusCode: http.StatusOK}
+			start = time.Now()
+			route = "unmatched"
+		)
+
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		next.ServeHTTP(sw, r)
+
+		if sw.StatusCode == http.StatusSwitchingProtocols {
+			return
+		}
+
+		httpRequestDuration.
+			WithLabelValues(route, r.Method, strconv.Itoa(sw.StatusCode)).
+			Observe(time.Since(start).Seconds())
+	})
+}
+
+// GraphQL
+//------------------------------------------------------------------------------
+
+// operation comes from PersistedQueries.operationLabel, so clients can't add
+// series at will. Operations that failed before being parsed have no type
+func observeOperation(
+	operation string,
+	analysis *QueryAnalysis,
+	errs []*errors.QueryError,
+	start time.Time,
+) {
+	operationType := "invalid"
+
+	if analysis != nil {
+		operationType = string(analysis.Operation)
+	}
+
+	graphqlOperationDuration.
+		WithLabelValues(operation, operationType).
+		Observe(time.Since(start).Seconds())
+
+	for _, err := range errs {
+		code, ok := err.Extensions["code"].(string)
+
+		if !ok {
+			code = "UNKNOWN"
+		}
+
+		graphqlErrors.WithLabelValues(operation, code).Inc()
+	}
+}
+
+// Dataloaders
+//------------------------------------------------------------------------------
+
+func observeBatch(loader key, batch dataloader.BatchFunc) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		loaderBatchSize.WithLabelValues(string(loader)).Observe(float64(len(keys)))
+		return batch(ctx, keys)
+	}
+}
+
+func observeCacheLookup(loader key, cache string, hit bool) {
+	result := "miss"
+
+	if hit {
+		result = "hit"
+	}
+
+	loaderCacheRequests.WithLabelValues(string(loader), cache, result).Inc()
+}
+
+// The request scoped dataloader cache, counting its hits and misses
+type ObservedCache struct {
+	dataloader.Cache
+	loader key
+}
+
+func newObservedCache(loader key) *ObservedCache {
+	return &ObservedCache{dataloader.NewCache(), loader}
+}
+
+func (self *ObservedCache) Get(ctx context.Context, k dataloader.Key) (dataloader.Thunk, bool) {
+	thunk, ok := self.Cache.Get(ctx, k)
+	observeCacheLookup(self.loader, "request", ok)
+	return thunk, ok
+}
+
+// Database
+//------------------------------------------------------------------------------
+
+// Times every statement gorm runs, trough its callbacks
+func instrumentDB(db *Database) {
+	if db.gorm == nil {
+		return
+	}
+
+	callbacks := db.gorm.Callback()
+
+	// Processors keep their position once registered, so each callback
+	// needs a fresh one
+	for operation, processor := range map[string]func() *gorm.CallbackProcessor{
+		"create":    callbacks.Create,
+		"query":     callbacks.Query,
+		"update":    callbacks.Update,
+		"delete":    callbacks.Delete,
+		"row_query": callbacks.RowQuery,
+	} {
+		processor().Before("gorm:"+operation).Register("metrics:before_"+operation, startStatement)
+		processor().After("gorm:"+operation).Register("metrics:after_"+operation, endStatement(operation))
+	}
+
+	stats := func() sql.DBStats { return db.gorm.DB().Stats() }
+
+	for name, value := range map[string]func(sql.DBStats) float64{
+		"open":   func(s sql.DBStats) float64 { return float64(s.OpenConnections) },
+		"in_use": func(s sql.DBStats) float64 { return float64(s.InUse) },
+		"idle":   func(s sql.DBStats) float64 { return float64(s.Idle) },
+	} {
+		value := value
+
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "grip_db_connections_" + name,
+			Help: "Connections in the database pool, " + name,
+		}, func() float64 { return value(stats()) })
+	}
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "grip_db_connection_waits_total",
+		Help: "Times a statement had to wait for a free connection",
+	}, func() float64 { return float64(stats().WaitCount) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "grip_db_connection_wait_seconds_total",
+		Help: "Time spent waiting for a free connection",
+	}, func() float64 { return stats().WaitDuration.Seconds() })
+}
+
+func startStatement(scope *gorm.Scope) {
+	scope.Set(dbStartedAtKey, time.Now())
+}
+
+func endStatement(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		value, ok := scope.Get(dbStartedAtKey)
+
+		if !ok {
+			return
+		}
+
+		table := scope.TableName()
+		dbQueryDuration.WithLabelValues(operation, table).Observe(time.Since(value.(time.Time)).Seconds())
+
+		if scope.HasError() && !gorm.IsRecordNotFoundError(scope.DB().Error) {
+			dbQueryErrors.WithLabelValues(operation, table).Inc()
+		}
+	}
+}
+
+// Scrapes need "Authorization: Bearer <metrics.token>" when it's set
+func metricsHandler(config *Config) http.Handler {
+	var (
+		handler = promhttp.Handler()
+		want    = []byte("Bearer " + config.MetricsToken)
+	)
+
+	if config.MetricsToken == "" {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// /metrics only goes on the API router without a metrics.address
+func registerMetricsRoutes(router *mux.Router, config *Config) {
+	if config.MetricsAddress == "" {
+		router.Handle("/metrics", metricsHandler(config))
+	}
+}
+
+// A listener of its own for /metrics, nil without a metrics.address
+func newMetricsServer(config *Config) *http.Server {
+	if config.MetricsAddress == "" {
+		return nil
+	}
+
+	handler := http.NewServeMux()
+	handler.Handle("/metrics", metricsHandler(config))
+
+	return &http.Server{
+		Addr:         config.MetricsAddress,
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		Handler:      handler,
+	}
+}
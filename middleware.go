@@ -1,16 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"time"
 )
 
-// Extending ResponseWriter, to store responses status code
+// Extending ResponseWriter, to store responses status code and size
 type StatusWriter struct {
 	http.ResponseWriter
 	StatusCode int
+	Bytes      int
 }
 
 func (w *StatusWriter) WriteHeader(code int) {
@@ -18,43 +20,48 @@ func (w *StatusWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += n
+	return n, err
+}
+
+// WebSocket upgrades need the underlying connection
+func (w *StatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		w.StatusCode = http.StatusSwitchingProtocols
+		return hijacker.Hijack()
+	}
+
+	return nil, nil, fmt.Errorf("ResponseWriter does not support hijacking")
+}
+
+// Tags the request with an ID, echoed back in X-Request-ID, and writes the
+// access log once the response is out. Query strings are left out, they can
+// carry tokens
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		b := new(bytes.Buffer)
-		sw := &StatusWriter{w, http.StatusOK}
-
-		fmt.Fprintf(
-			b,
-			"%s \"%s %s %s\" %d %s %d \"%s\" \"%s\"",
-			r.RemoteAddr,
-			r.Method,
-			r.URL,
-			r.Proto,
-			sw.StatusCode,
-			http.StatusText(sw.StatusCode),
-			r.ContentLength,
-			r.RequestURI,
-			r.Header.Get("User-Agent"),
+		var (
+			sw    = &StatusWriter{ResponseWriter: w, StatusCode: http.StatusOK}
+			start = time.Now()
+			id    = requestID(r)
 		)
 
-		log.Println(b)
+		w.Header().Set(requestIDHeader, id)
+		r, requestLogger := withRequestLogger(r, id)
+
 		next.ServeHTTP(sw, r)
-	})
-}
 
-// FIXME: Remove this
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Content-Length, Accept-Encoding")
-
-		if r.Method == "OPTIONS" {
-			fmt.Println("Giving cors")
-			w.Header().Set("Access-Control-Max-Age", "86400")
-			w.WriteHeader(http.StatusOK)
-		} else {
-			next.ServeHTTP(w, r)
-		}
+		requestLogger.Info(
+			"Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"proto", r.Proto,
+			"status", sw.StatusCode,
+			"bytes", sw.Bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
 	})
 }
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"math"
 	"strconv"
+	"time"
 
 	graphql "github.com/graph-gophers/graphql-go"
 )
@@ -36,17 +37,36 @@ func (self User) PROJECTID() *int32 {
 	return nil
 }
 
+// The Project this User owns, looked up by owner rather than ProjectID
 func (self User) PROJECT(ctx context.Context) *Project {
-	if self.ProjectID != nil {
-		if item, err := loadSomething(ctx, strconv.Itoa(int(*self.ProjectID)), projectLoaderKey); err == nil {
-			project := item.(Project)
-			return &project
+	if item, err := loadSomething(ctx, self.ID, projectsByOwnerLoaderKey); err == nil {
+		for _, project := range item.([]Project) {
+			if project.visibleTo(ctx) {
+				return &project
+			}
 		}
 	}
 
 	return nil
 }
 
+// Every vote this User cast, voided ones left out
+func (self User) RAITINGS(ctx context.Context) []Raiting {
+	if item, err := loadSomething(ctx, self.ID, raitingsByOwnerLoaderKey); err == nil {
+		return counted(item.([]Raiting))
+	}
+
+	return []Raiting{}
+}
+
+func (self User) ROLES() []Role {
+	return self.roles()
+}
+
+func (self User) BANNED() bool {
+	return self.BannedAt != nil
+}
+
 // Project
 //------------------------------------------------------------------------------
 
@@ -60,7 +80,7 @@ func (self *Project) String() string {
 
 func (self *Project) OWNER(ctx context.Context) *User {
 	if self.OwnerID != "" {
-		fmt.Printf("Fetching projects (%d) owner with ID %s\n", self.ID, self.OwnerID)
+		loggerFrom(ctx).Debug("Fetching project owner", "project_id", self.ID, "user_id", self.OwnerID)
 		if item, err := loadSomething(ctx, self.OwnerID, userLoaderKey); err == nil {
 			owner := item.(User)
 			return &owner
@@ -91,17 +111,41 @@ func (self *Project) PICTURE() string {
 }
 
 func (self *Project) TEAM(ctx context.Context) []User {
-	users := make([]User, len(self.TeamUsers))
+	items := loadMany(ctx, self.TeamUsers, userLoaderKey)
+	users := make([]User, len(items))
 
-	for i, id := range self.TeamUsers {
-		if item, err := loadSomething(ctx, id, userLoaderKey); err == nil {
-			users[i] = item.(User)
-		}
+	for i, item := range items {
+		users[i] = item.(User)
 	}
 
 	return users
 }
 
+func (self *Project) HIDDEN() bool {
+	return self.HiddenAt != nil
+}
+
+// Hidden projects are only shown to their owner and moderators
+func (self *Project) visibleTo(ctx context.Context) bool {
+	if self.HiddenAt == nil {
+		return true
+	}
+
+	viewer := viewerFrom(ctx)
+	return viewer.ID == self.OwnerID || viewer.hasRole(ctx, RoleModerator)
+}
+
+// Loads a Project for an edge pointing at it, nil when the viewer can't see it
+func visibleProject(ctx context.Context, id uint) *Project {
+	if item, err := loadSomething(ctx, strconv.Itoa(int(id)), projectLoaderKey); err == nil {
+		if project := item.(Project); project.visibleTo(ctx) {
+			return &project
+		}
+	}
+
+	return nil
+}
+
 func (self *Project) THEME() int32 {
 	return self.Theme
 }
@@ -115,27 +159,103 @@ func (self *Project) RAITING() []int32 {
 	return raiting
 }
 
-func (self *Project) RAITINGS(ctx context.Context) []Raiting {
-	raitings := make([]Raiting, len(self.RaitingIDs))
-	for i, id := range self.RaitingIDs {
-		if item, err := loadSomething(ctx, strconv.Itoa(int(id)), raitingLoaderKey); err == nil {
-			raitings[i] = item.(Raiting)
+func (self *Project) JUDGERAITING() []int32 {
+	raiting := make([]int32, len(self.JudgeRaiting))
+	for i, val := range self.JudgeRaiting {
+		raiting[i] = safeInt32(int(val))
+	}
+
+	return raiting
+}
+
+// Public and jury averages mixed by scoring.jury_weight. A side nobody voted
+// on yet is left out, instead of dragging the score down with zeros
+func (self *Project) FINALRAITING(ctx context.Context) []int32 {
+	var (
+		weight = stateFrom(ctx).config.JuryWeight
+		public = self.RaitingCount > 0 && len(self.Raiting) == 5
+		jury   = self.JudgeRaitingCount > 0 && len(self.JudgeRaiting) == 5
+		final  = make([]int32, 5)
+	)
+
+	for i := range final {
+		switch {
+		case public && jury:
+			final[i] = safeInt32(int(math.Round(
+				float64(self.JudgeRaiting[i])*weight + float64(self.Raiting[i])*(1-weight),
+			)))
+		case jury:
+			final[i] = safeInt32(int(self.JudgeRaiting[i]))
+		case public:
+			final[i] = safeInt32(int(self.Raiting[i]))
 		}
 	}
 
-	return raitings
+	return final
+}
+
+// Written feedback is only for the team behind the project and the jury
+func (self *Project) JUDGERAITINGS(ctx context.Context) []JudgeRaiting {
+	viewer := viewerFrom(ctx)
+
+	if viewer.ID != self.OwnerID && !viewer.hasRole(ctx, RoleJudge) {
+		return []JudgeRaiting{}
+	}
+
+	if item, err := loadSomething(ctx, self.String(), judgeRaitingsByProjectLoaderKey); err == nil {
+		return item.([]JudgeRaiting)
+	}
+
+	return []JudgeRaiting{}
+}
+
+func (self *Project) COMMENTS(ctx context.Context) []Comment {
+	if item, err := loadSomething(ctx, self.String(), commentsByProjectLoaderKey); err == nil {
+		return item.([]Comment)
+	}
+
+	return []Comment{}
+}
+
+func (self *Project) RAITINGS(ctx context.Context) []Raiting {
+	if item, err := loadSomething(ctx, self.String(), raitingsByProjectLoaderKey); err == nil {
+		return counted(item.([]Raiting))
+	}
+
+	return []Raiting{}
 }
 
 // Raiting
 //------------------------------------------------------------------------------
 
+// Leaves out voided votes
+func counted(raitings []Raiting) []Raiting {
+	items := make([]Raiting, 0, len(raitings))
+
+	for _, raiting := range raitings {
+		if raiting.VoidedAt == nil {
+			items = append(items, raiting)
+		}
+	}
+
+	return items
+}
+
 func (self *Raiting) String() string {
 	return strconv.Itoa(int(self.ID))
 }
 
+func (self Raiting) Id() graphql.ID {
+	return graphql.ID(strconv.Itoa(int(self.ID)))
+}
+
+func (self Raiting) VOIDED() bool {
+	return self.VoidedAt != nil
+}
+
 func (self Raiting) OWNER(ctx context.Context) *User {
 	if self.OwnerID != "" {
-		fmt.Printf("Fetching Raitings (%d) owner with ID %s\n", self.ID, self.OwnerID)
+		loggerFrom(ctx).Debug("Fetching raiting owner", "raiting_id", self.ID, "user_id", self.OwnerID)
 		if item, err := loadSomething(ctx, self.OwnerID, userLoaderKey); err == nil {
 			owner := item.(User)
 			return &owner
@@ -146,14 +266,8 @@ func (self Raiting) OWNER(ctx context.Context) *User {
 }
 
 func (self Raiting) PROJECT(ctx context.Context) *Project {
-	fmt.Printf("Fetching raitings (%d) project with ID %s\n", self.ID, self.OwnerID)
-
-	if item, err := loadSomething(ctx, strconv.Itoa(int(self.ProjectID)), projectLoaderKey); err == nil {
-		project := item.(Project)
-		return &project
-	}
-
-	return nil
+	loggerFrom(ctx).Debug("Fetching raiting project", "raiting_id", self.ID, "project_id", self.ProjectID)
+	return visibleProject(ctx, self.ProjectID)
 }
 
 func (self Raiting) DESIGN() int32 {
@@ -171,3 +285,125 @@ func (self Raiting) RESPONSIVENESS() int32 {
 func (self Raiting) MOTION() int32 {
 	return safeInt32(self.Motion)
 }
+
+// JudgeRaiting
+//------------------------------------------------------------------------------
+
+func (self JudgeRaiting) Id() graphql.ID {
+	return graphql.ID(strconv.Itoa(int(self.ID)))
+}
+
+func (self JudgeRaiting) JUDGE(ctx context.Context) *User {
+	if item, err := loadSomething(ctx, self.JudgeID, userLoaderKey); err == nil {
+		judge := item.(User)
+		return &judge
+	}
+
+	return nil
+}
+
+func (self JudgeRaiting) PROJECT(ctx context.Context) *Project {
+	return visibleProject(ctx, self.ProjectID)
+}
+
+func (self JudgeRaiting) DESIGN() int32 {
+	return safeInt32(self.Design)
+}
+func (self JudgeRaiting) PERFORMANCE() int32 {
+	return safeInt32(self.Performance)
+}
+func (self JudgeRaiting) EASEOFUSE() int32 {
+	return safeInt32(self.EaseOfUse)
+}
+func (self JudgeRaiting) RESPONSIVENESS() int32 {
+	return safeInt32(self.Responsiveness)
+}
+func (self JudgeRaiting) MOTION() int32 {
+	return safeInt32(self.Motion)
+}
+func (self JudgeRaiting) FEEDBACK() string {
+	return self.Feedback
+}
+
+// Comment
+//------------------------------------------------------------------------------
+
+func (self Comment) Id() graphql.ID {
+	return graphql.ID(strconv.Itoa(int(self.ID)))
+}
+
+func (self Comment) AUTHOR(ctx context.Context) *User {
+	if item, err := loadSomething(ctx, self.AuthorID, userLoaderKey); err == nil {
+		author := item.(User)
+		return &author
+	}
+
+	return nil
+}
+
+func (self Comment) PROJECT(ctx context.Context) *Project {
+	return visibleProject(ctx, self.ProjectID)
+}
+
+func (self Comment) BODY() string {
+	return self.Body
+}
+
+func (self Comment) CREATEDAT() string {
+	return self.CreatedAt.Format(time.RFC3339)
+}
+
+// ModerationEntry
+//------------------------------------------------------------------------------
+
+func (self *ModerationEntry) Id() graphql.ID {
+	return graphql.ID(strconv.Itoa(int(self.ID)))
+}
+
+func (self *ModerationEntry) CREATEDAT() string {
+	return self.CreatedAt.Format(time.RFC3339)
+}
+
+func (self *ModerationEntry) MODERATOR(ctx context.Context) *User {
+	if item, err := loadSomething(ctx, self.ModeratorID, userLoaderKey); err == nil {
+		moderator := item.(User)
+		return &moderator
+	}
+
+	return nil
+}
+
+func (self *ModerationEntry) ACTION() ModerationAction {
+	return self.Action
+}
+
+func (self *ModerationEntry) TARGETTYPE() string {
+	return self.TargetType
+}
+
+func (self *ModerationEntry) TARGETID() string {
+	return self.TargetID
+}
+
+func (self *ModerationEntry) REASON() string {
+	return self.Reason
+}
+
+func (self *ModerationEntry) DETAILS() string {
+	return self.Details
+}
+
+// SuspiciousVote
+//------------------------------------------------------------------------------
+
+func (self *SuspiciousVote) RAITING() Raiting {
+	return self.Raiting
+}
+
+func (self *SuspiciousVote) FLAGS() []VoteFlag {
+	return self.Flags
+}
+
+func (self *SuspiciousVote) EXCLUDED() bool {
+	return self.Excluded
+}
@@ -6,7 +6,6 @@ import (
 	jwt "github.com/dgrijalva/jwt-go"
 	// graphql "github.com/graph-gophers/graphql-go"
 	"github.com/jinzhu/gorm"
-	"github.com/lib/pq"
 	"golang.org/x/oauth2"
 )
 
@@ -43,10 +42,12 @@ type User struct {
 	Avatar           string
 	Discriminator    string
 	Email            *string
-	IsAdmin          bool          `gorm:"default:false"`
-	Voted            pq.Int64Array `gorm:"type:int[]"`
-	Seen             pq.Int64Array `gorm:"type:int[]"`
-	Visited          pq.Int64Array `gorm:"type:int[]"`
+	IsAdmin          bool `gorm:"default:false"`
+	BannedAt         *time.Time
+	Roles            StringList
+	Voted            IntList
+	Seen             IntList
+	Visited          IntList
 	Project          *Project
 	ProjectID        *uint
 	LastCommentCount int32
@@ -63,11 +64,16 @@ type Project struct {
 	Description string
 	Flags       string
 	Picture     string
-	TeamUsers   pq.StringArray `gorm:"type:text[]"`
+	TeamUsers   StringList
 	Theme       int32
-	Raiting     pq.Int64Array `gorm:"type:int[]"`
-	RaitingIDs  pq.Int64Array `gorm:"type:int[]"`
-	Raitings    []Raiting     `gorm:"foreignKey:ProjectID"`
+	HiddenAt    *time.Time
+	Raiting     IntList
+	Raitings    []Raiting `gorm:"foreignKey:ProjectID"`
+	// Votes counted in Raiting, voided and excluded ones aren't
+	RaitingCount int
+	// Jury averages, kept apart from the public Raiting
+	JudgeRaiting      IntList
+	JudgeRaitingCount int
 }
 
 type Projects []*Project
@@ -83,6 +89,62 @@ type Raiting struct {
 	EaseOfUse      int
 	Responsiveness int
 	Motion         int
+	VoidedAt       *time.Time
 }
 
 type Raitings []*Raiting
+
+// Same categories as Raiting, but cast by a JUDGE and never mixed into the
+// public averages
+type JudgeRaiting struct {
+	gorm.Model
+	Judge          User
+	JudgeID        string `sql:"index"`
+	Project        Project
+	ProjectID      uint `sql:"index"`
+	Design         int
+	Performance    int
+	EaseOfUse      int
+	Responsiveness int
+	Motion         int
+	Feedback       string `gorm:"type:text"`
+}
+
+type JudgeRaitings []*JudgeRaiting
+
+// Left on a Project by a participant
+type Comment struct {
+	gorm.Model
+	Author    User
+	AuthorID  string `sql:"index"`
+	Project   Project
+	ProjectID uint   `sql:"index"`
+	Body      string `gorm:"type:text"`
+}
+
+type Comments []*Comment
+
+// Append only, rows are never updated or deleted
+type ModerationEntry struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	ModeratorID string `sql:"index"`
+	Action      ModerationAction
+	TargetType  string `sql:"index"`
+	TargetID    string `sql:"index"`
+	Reason      string
+	Details     string
+}
+
+type ModerationEntries []*ModerationEntry
+
+type ModerationAction string
+
+const (
+	ModerationBanUser         ModerationAction = "BAN_USER"
+	ModerationUnbanUser       ModerationAction = "UNBAN_USER"
+	ModerationHideProject     ModerationAction = "HIDE_PROJECT"
+	ModerationUnhideProject   ModerationAction = "UNHIDE_PROJECT"
+	ModerationVoidRaiting     ModerationAction = "VOID_RAITING"
+	ModerationTransferProject ModerationAction = "TRANSFER_PROJECT"
+)
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/graph-gophers/graphql-go/errors"
+	"github.com/jinzhu/gorm"
+	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/parser"
+)
+
+// Where registered queries live, keyed by the sha256 of their text
+type QueryStore interface {
+	get(hash string) (string, bool, error)
+	put(hash string, query string) error
+}
+
+type persistedQueryParams struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+type requestExtensions struct {
+	PersistedQuery *persistedQueryParams `json:"persistedQuery"`
+}
+
+// Apollo automatic persisted queries: clients first send only the hash and
+// fall back to hash + query when the server doesn't know it yet. In
+// allowlist mode nothing outside the build time manifest is executed, and
+// nothing is registered
+type PersistedQueries struct {
+	store      QueryStore
+	manifest   map[string]string // Never evicted, unlike client registrations
+	operations map[string]bool   // Operation names declared in the manifest
+	strict     bool
+}
+
+func newPersistedQueries(config *Config, db *Database) *PersistedQueries {
+	var store QueryStore
+
+	switch config.PersistedQueryStore {
+	case "postgres":
+		if db.gorm == nil || db.gorm.Dialect().GetName() != "postgres" {
+			fatal("persisted_queries.store postgres needs database.dialect postgres")
+		}
+
+		store = &PostgresQueryStore{gorm: db.gorm, size: config.PersistedQuerySize}
+	case "", "memory":
+		store = &MemoryQueryStore{items: newLRU(config.PersistedQuerySize, 0)}
+	default:
+		fatal("Unknown persisted_queries.store, expected memory or postgres", "store", config.PersistedQueryStore)
+	}
+
+	self := &PersistedQueries{
+		store:      store,
+		manifest:   make(map[string]string),
+		operations: make(map[string]bool),
+		strict:     config.PersistedQueryAllowlist,
+	}
+
+	if config.PersistedQueryManifest != "" {
+		if err := self.loadManifest(config.PersistedQueryManifest); err != nil {
+			fatal("Failed to load persisted query manifest", "error", err)
+		}
+	} else if self.strict {
+		fatal("persisted_queries.allowlist requires a persisted_queries.manifest")
+	}
+
+	return self
+}
+
+// Accepts a plain {"<sha256>": "<query>"} object, or Apollos
+// {"operations": [{"id": "<sha256>", "body": "<query>"}]} manifest
+func (self *PersistedQueries) loadManifest(path string) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	var (
+		queries  = make(map[string]string)
+		manifest struct {
+			Operations []struct {
+				ID   string `json:"id"`
+				Body string `json:"body"`
+			} `json:"operations"`
+		}
+	)
+
+	if err := json.Unmarshal(data, &manifest); err == nil && manifest.Operations != nil {
+		for _, operation := range manifest.Operations {
+			queries[operation.ID] = operation.Body
+		}
+	} else if err := json.Unmarshal(data, &queries); err != nil {
+		return err
+	}
+
+	for hash, query := range queries {
+		if hashQuery(query) != hash {
+			logger.Warn("Skipping manifest entry, its hash doesn't match the query", "hash", hash)
+			continue
+		}
+
+		self.manifest[hash] = query
+
+		if doc, err := parser.ParseQuery(&ast.Source{Input: query}); err == nil {
+			for _, operation := range doc.Operations {
+				if operation.Name != "" {
+					self.operations[operation.Name] = true
+				}
+			}
+		}
+	}
+
+	logger.Info("Loaded persisted queries", "count", len(self.manifest), "path", path)
+	return nil
+}
+
+// Operation names end up in metric labels. Only names declared in the
+// manifest are used, anything else a client sends is labeled other
+func (self *PersistedQueries) operationLabel(name string) string {
+	switch {
+	case name == "":
+		return "anonymous"
+	case self.operations[name]:
+		return name
+	default:
+		return "other"
+	}
+}
+
+// Returns the query text to execute, either as sent or looked up by hash
+func (self *PersistedQueries) resolve(
+	query string,
+	extensions *requestExtensions,
+) (string, *errors.QueryError) {
+	var hash string
+
+	if extensions != nil && extensions.PersistedQuery != nil {
+		if extensions.PersistedQuery.Version != 1 {
+			return "", persistedQueryError("PersistedQueryNotSupported", "PERSISTED_QUERY_NOT_SUPPORTED")
+		}
+
+		hash = extensions.PersistedQuery.Sha256Hash
+	}
+
+	if query == "" {
+		if hash == "" {
+			return "", errors.Errorf("no query provided")
+		}
+
+		if stored, ok := self.manifest[hash]; ok {
+			return stored, nil
+		}
+
+		if self.strict {
+			return "", persistedQueryError("PersistedQueryNotFound", "PERSISTED_QUERY_NOT_FOUND")
+		}
+
+		stored, ok, err := self.store.get(hash)
+
+		if err != nil {
+			logger.Error("Persisted query lookup failed", "hash", hash, "error", err)
+		}
+
+		if !ok {
+			return "", persistedQueryError("PersistedQueryNotFound", "PERSISTED_QUERY_NOT_FOUND")
+		}
+
+		return stored, nil
+	}
+
+	actual := hashQuery(query)
+
+	if hash != "" && hash != actual {
+		return "", persistedQueryError("provided sha does not match query", "PERSISTED_QUERY_HASH_MISMATCH")
+	}
+
+	if self.strict {
+		if _, ok := self.manifest[actual]; !ok {
+			return "", persistedQueryError("query is not in the persisted query allowlist", "PERSISTED_QUERY_NOT_ALLOWED")
+		}
+
+		return query, nil
+	}
+
+	// Register on miss, manifest queries are known already
+	if _, known := self.manifest[hash]; hash != "" && !known {
+		if err := self.store.put(hash, query); err != nil {
+			logger.Error("Failed to persist query", "hash", hash, "error", err)
+		}
+	}
+
+	return query, nil
+}
+
+func hashQuery(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+func persistedQueryError(message string, code string) *errors.QueryError {
+	return &errors.QueryError{
+		Message:    message,
+		Extensions: map[string]interface{}{"code": code},
+	}
+}
+
+// Memory store
+//------------------------------------------------------------------------------
+
+// Per instance, bounded by persisted_queries.size so clients can't grow it
+// forever
+type MemoryQueryStore struct {
+	items *LRU
+}
+
+func (self *MemoryQueryStore) get(hash string) (string, bool, error) {
+	if query, ok := self.items.get(hash); ok {
+		return query.(string), true, nil
+	}
+
+	return "", false, nil
+}
+
+func (self *MemoryQueryStore) put(hash string, query string) error {
+	self.items.set(hash, query)
+	return nil
+}
+
+// Postgres store
+//------------------------------------------------------------------------------
+
+type PersistedQuery struct {
+	Hash      string `gorm:"primary_key"`
+	CreatedAt time.Time
+	Query     string `gorm:"type:text"`
+}
+
+// Shared between instances, so a query registered on one is known to all.
+// Keeps the size most recently registered queries
+type PostgresQueryStore struct {
+	gorm *gorm.DB
+	size int
+}
+
+func (self *PostgresQueryStore) get(hash string) (string, bool, error) {
+	var item PersistedQuery
+	req := self.gorm.First(&item, "hash = ?", hash)
+
+	if req.RecordNotFound() {
+		return "", false, nil
+	}
+
+	return item.Query, req.Error == nil, req.Error
+}
+
+func (self *PostgresQueryStore) put(hash string, query string) error {
+	item := PersistedQuery{Hash: hash, Query: query}
+	req := self.gorm.Where(&PersistedQuery{Hash: hash}).FirstOrCreate(&item)
+
+	if req.Error != nil || req.RowsAffected == 0 {
+		return req.Error
+	}
+
+	// Only registrations add rows, so trimming after each one keeps the
+	// table at size
+	return self.gorm.Exec(
+		"DELETE FROM persisted_queries WHERE hash IN "+
+			"(SELECT hash FROM persisted_queries ORDER BY created_at DESC, hash OFFSET ?)",
+		self.size,
+	).Error
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestPersistedQueries(t *testing.T) {
+	var (
+		query   = `{ users { id } }`
+		hash    = hashQuery(query)
+		other   = `{ projects { id } }`
+		listed  = `query Listed { projects { id } }`
+		unknown = hashQuery(`{ nothing }`)
+	)
+
+	persisted := func(version int, hash string) *requestExtensions {
+		return &requestExtensions{PersistedQuery: &persistedQueryParams{Version: version, Sha256Hash: hash}}
+	}
+
+	// Steps run in order, the allowlist has its own registrations
+	modes := map[bool]*PersistedQueries{}
+
+	for _, strict := range []bool{false, true} {
+		modes[strict] = &PersistedQueries{
+			store:    &MemoryQueryStore{items: newLRU(10, 0)},
+			manifest: map[string]string{hashQuery(listed): listed},
+			strict:   strict,
+		}
+	}
+
+	for _, step := range []struct {
+		name       string
+		strict     bool
+		query      string
+		extensions *requestExtensions
+		resolved   string
+		code       string
+	}{
+		{"plain query", false, other, nil, other, ""},
+		{"unknown hash", false, "", persisted(1, hash), "", "PERSISTED_QUERY_NOT_FOUND"},
+		{"register", false, query, persisted(1, hash), query, ""},
+		{"registered hash", false, "", persisted(1, hash), query, ""},
+		{"manifest hash", false, "", persisted(1, hashQuery(listed)), listed, ""},
+		{"hash of another query", false, other, persisted(1, hash), "", "PERSISTED_QUERY_HASH_MISMATCH"},
+		{"unsupported version", false, "", persisted(2, hash), "", "PERSISTED_QUERY_NOT_SUPPORTED"},
+		{"nothing", false, "", nil, "", "no query provided"},
+		{"allowlist: manifest hash", true, "", persisted(1, hashQuery(listed)), listed, ""},
+		{"allowlist: manifest query", true, listed, nil, listed, ""},
+		{"allowlist: query outside the manifest", true, other, nil, "", "PERSISTED_QUERY_NOT_ALLOWED"},
+		{"allowlist: registration is refused", true, query, persisted(1, hash), "", "PERSISTED_QUERY_NOT_ALLOWED"},
+		{"allowlist: and not stored", true, "", persisted(1, hash), "", "PERSISTED_QUERY_NOT_FOUND"},
+		{"allowlist: unknown hash", true, "", persisted(1, unknown), "", "PERSISTED_QUERY_NOT_FOUND"},
+	} {
+		resolved, err := modes[step.strict].resolve(step.query, step.extensions)
+		code := ""
+
+		if err != nil {
+			code, _ = err.Extensions["code"].(string)
+
+			if code == "" {
+				code = err.Message
+			}
+		}
+
+		if resolved != step.resolved || code != step.code {
+			t.Errorf("%s: got %q %q, expected %q %q", step.name, resolved, code, step.resolved, step.code)
+		}
+	}
+}
+
+func TestPersistedQueryManifest(t *testing.T) {
+	var (
+		listed   = `query Listed { projects { id } }`
+		tampered = `query Tampered { users { id } }`
+	)
+
+	for name, manifest := range map[string]string{
+		"plain":  `{"` + hashQuery(listed) + `": "` + listed + `", "` + hashQuery(listed) + `0": "` + tampered + `"}`,
+		"apollo": `{"operations": [{"id": "` + hashQuery(listed) + `", "body": "` + listed + `"}, {"id": "` + hashQuery(listed) + `0", "body": "` + tampered + `"}]}`,
+	} {
+		path := t.TempDir() + "/manifest.json"
+
+		if err := ioutil.WriteFile(path, []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		queries := &PersistedQueries{manifest: make(map[string]string), operations: make(map[string]bool)}
+
+		if err := queries.loadManifest(path); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if len(queries.manifest) != 1 || queries.manifest[hashQuery(listed)] != listed {
+			t.Errorf("%s: expected only the entry with a matching hash, got %v", name, queries.manifest)
+		}
+
+		for operation, label := range map[string]string{"Listed": "Listed", "Tampered": "other", "": "anonymous"} {
+			if got := queries.operationLabel(operation); got != label {
+				t.Errorf("%s: %q labeled %q, expected %q", name, operation, got, label)
+			}
+		}
+	}
+}
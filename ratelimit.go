@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graph-gophers/graphql-go/errors"
+	"github.com/jinzhu/gorm"
+	"github.com/vektah/gqlparser/ast"
+)
+
+const (
+	rateLimitContextKey contextKey = "rateLimits"
+
+	// Buckets kept by the memory store, the least recently used go first
+	rateLimitCacheSize = 10000
+
+	// How often the postgres store drops buckets that have refilled
+	rateLimitPruneEvery = time.Minute
+)
+
+// Limit requests per Per, refilled smoothly. A full bucket allows a burst of
+// Limit requests
+type Rate struct {
+	Limit int
+	Per   time.Duration
+}
+
+// Parses 30/1m, 0 or an empty string disable the limit
+func parseRate(value string) (Rate, bool, error) {
+	if value == "" || value == "0" {
+		return Rate{}, false, nil
+	}
+
+	parts := strings.SplitN(value, "/", 2)
+
+	if len(parts) != 2 {
+		return Rate{}, false, fmt.Errorf("expected <requests>/<duration>, got %s", value)
+	}
+
+	limit, err := strconv.Atoi(parts[0])
+
+	if err != nil || limit < 1 {
+		return Rate{}, false, fmt.Errorf("invalid request count in %s", value)
+	}
+
+	per, err := time.ParseDuration(parts[1])
+
+	if err != nil || per <= 0 {
+		return Rate{}, false, fmt.Errorf("invalid duration in %s", value)
+	}
+
+	return Rate{limit, per}, true, nil
+}
+
+// Tokens refilled per second
+func (self Rate) refill() float64 {
+	return float64(self.Limit) / self.Per.Seconds()
+}
+
+// Refills a bucket that had tokens left elapsed ago, then takes one out of it
+func (self Rate) take(tokens float64, elapsed time.Duration) (float64, *RateLimitResult) {
+	var (
+		capacity = float64(self.Limit)
+		refill   = self.refill()
+		result   = &RateLimitResult{Limit: self.Limit}
+	)
+
+	tokens = math.Min(capacity, tokens+elapsed.Seconds()*refill)
+
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - tokens) / refill)
+	}
+
+	result.Remaining = int(tokens)
+	result.Reset = seconds((capacity - tokens) / refill)
+	return tokens, result
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // Until the bucket is full again
+	RetryAfter time.Duration // Until the next request is allowed, when denied
+}
+
+// Where the buckets live
+type RateLimitStore interface {
+	take(ctx context.Context, key string, rate Rate) (*RateLimitResult, error)
+}
+
+// Token buckets keyed by the authenticated user_id, or the client IP, for
+// every limited GraphQL root field and for /auth/login
+type RateLimiter struct {
+	store          RateLimitStore
+	limits         map[string]Rate // Lower case, viper folds config keys
+	trustForwarded bool
+}
+
+func newRateLimiter(config *Config, db *Database) *RateLimiter {
+	var (
+		limits = make(map[string]Rate)
+		window time.Duration
+	)
+
+	for name, value := range config.RateLimits {
+		rate, enabled, err := parseRate(value)
+
+		if err != nil {
+			fatal("Invalid ratelimit.limits entry", "operation", name, "error", err)
+		}
+
+		if enabled {
+			limits[strings.ToLower(name)] = rate
+
+			if rate.Per > window {
+				window = rate.Per
+			}
+		}
+	}
+
+	var store RateLimitStore
+
+	switch config.RateLimitStore {
+	case "postgres":
+		if db.gorm == nil || db.gorm.Dialect().GetName() != "postgres" {
+			fatal("ratelimit.store postgres needs database.dialect postgres")
+		}
+
+		store = &PostgresRateLimitStore{gorm: db.gorm, timeout: db.timeout, window: window}
+	case "", "memory":
+		store = &MemoryRateLimitStore{buckets: newLRU(rateLimitCacheSize, 0)}
+	default:
+		fatal("Unknown ratelimit.store, expected memory or postgres", "store", config.RateLimitStore)
+	}
+
+	return &RateLimiter{
+		store:          store,
+		limits:         limits,
+		trustForwarded: config.RateLimitTrustForwarded,
+	}
+}
+
+// Takes a token for operation, nil when it isn't limited. Store failures
+// let the request trough, the limiter shouldn't take the API down with it
+func (self *RateLimiter) take(ctx context.Context, operation string) *RateLimitResult {
+	rate, ok := self.limits[strings.ToLower(operation)]
+
+	if !ok {
+		return nil
+	}
+
+	key := strings.ToLower(operation) + ":" + rateLimitClient(ctx)
+	result, err := self.store.take(ctx, key, rate)
+
+	if err != nil {
+		loggerFrom(ctx).Error("Rate limit lookup failed", "operation", operation, "error", err)
+		return nil
+	}
+
+	rateLimitsFrom(ctx).record(result)
+
+	if !result.Allowed {
+		rateLimited.WithLabelValues(strings.ToLower(operation)).Inc()
+		loggerFrom(ctx).Warn("Rate limited", "operation", operation, "client", rateLimitClient(ctx))
+	}
+
+	return result
+}
+
+// Every root field of the operation takes a token, aliases included. The
+// first exhausted one fails the whole operation
+func (self *RateLimiter) check(ctx context.Context, analysis *QueryAnalysis) []*errors.QueryError {
+	if self == nil || analysis == nil {
+		return nil
+	}
+
+	for _, field := range analysis.Fields {
+		result := self.take(ctx, field)
+
+		if result == nil || result.Allowed {
+			continue
+		}
+
+		return []*errors.QueryError{{
+			Message: fmt.Sprintf("rate limit for %s exceeded, retry in %s", field, result.RetryAfter),
+			Extensions: map[string]interface{}{
+				"code":       "RATE_LIMITED",
+				"retryAfter": int(result.RetryAfter.Seconds()),
+			},
+		}}
+	}
+
+	return nil
+}
+
+// Puts the client and a fresh report on the request context, the GraphQL
+// operations and limit() record their results into it
+func (self *RateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := &RateLimits{client: "ip:" + clientIP(r, self.trustForwarded)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitContextKey, limits)))
+	})
+}
+
+// Guards a plain HTTP route, answering 429 once operation is exhausted
+func (self *RateLimiter) limit(operation string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := self.take(r.Context(), operation)
+		rateLimitsFrom(r.Context()).writeHeaders(w)
+
+		if result != nil && !result.Allowed {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Root fields the operation selects, fragments expanded
+func rootFields(doc *ast.QueryDocument, op *ast.OperationDefinition) []string {
+	var fields []string
+
+	walkSelections(doc, op, func(field *ast.Field, depth int) {
+		if depth == 1 && !strings.HasPrefix(field.Name, "__") {
+			fields = append(fields, field.Name)
+		}
+	})
+
+	return fields
+}
+
+// Behind a proxy RemoteAddr is the proxy, it appends the actual client to
+// X-Forwarded-For. Entries before that are whatever the client sent
+func clientIP(r *http.Request, trustForwarded bool) string {
+	if forwarded := r.Header.Values("X-Forwarded-For"); trustForwarded && len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// The viewer once authenticated, so users behind one NAT don't share limits
+func rateLimitClient(ctx context.Context) string {
+	if viewer := viewerFrom(ctx); viewer.Authorized {
+		return "user:" + viewer.ID
+	}
+
+	return rateLimitsFrom(ctx).client
+}
+
+// Request report
+//------------------------------------------------------------------------------
+
+// The most restrictive result of a request, for its RateLimit headers.
+// Batched operations record concurrently
+type RateLimits struct {
+	sync.Mutex
+	client string
+	result *RateLimitResult
+}
+
+// Requests that didn't go trough the middleware get a throwaway report
+func rateLimitsFrom(ctx context.Context) *RateLimits {
+	if limits, ok := ctx.Value(rateLimitContextKey).(*RateLimits); ok {
+		return limits
+	}
+
+	return &RateLimits{client: "ip:unknown"}
+}
+
+func (self *RateLimits) record(result *RateLimitResult) {
+	self.Lock()
+	defer self.Unlock()
+
+	switch current := self.result; {
+	case current == nil,
+		current.Allowed && !result.Allowed,
+		current.Allowed == result.Allowed && result.Remaining < current.Remaining:
+		self.result = result
+	}
+}
+
+func (self *RateLimits) writeHeaders(w http.ResponseWriter) {
+	self.Lock()
+	defer self.Unlock()
+
+	if self.result == nil {
+		return
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(self.result.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(self.result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(self.result.Reset.Seconds())))
+
+	if !self.result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(int(self.result.RetryAfter.Seconds())))
+	}
+}
+
+// Memory store
+//------------------------------------------------------------------------------
+
+// Per instance. A bucket left alone for its whole period is full again, so
+// it's dropped then
+type MemoryRateLimitStore struct {
+	sync.Mutex
+	buckets *LRU
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+func (self *MemoryRateLimitStore) take(ctx context.Context, key string, rate Rate) (*RateLimitResult, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	var (
+		now    = time.Now()
+		bucket = &memoryBucket{float64(rate.Limit), now}
+	)
+
+	if cached, ok := self.buckets.get(key); ok {
+		bucket = cached.(*memoryBucket)
+	}
+
+	tokens, result := rate.take(bucket.tokens, now.Sub(bucket.updatedAt))
+	self.buckets.setTTL(key, &memoryBucket{tokens, now}, rate.Per)
+
+	return result, nil
+}
+
+// Postgres store
+//------------------------------------------------------------------------------
+
+type RateLimitBucket struct {
+	ID        string `gorm:"primary_key"`
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Shared between instances. The bucket row is locked while it's updated, so
+// concurrent requests can't both take the last token. Refills are timed by
+// the database clock, instances' clocks may disagree
+type PostgresRateLimitStore struct {
+	gorm    *gorm.DB
+	timeout time.Duration // database.statement_timeout
+	window  time.Duration // Longest configured period
+
+	sync.Mutex
+	prunedAt time.Time
+}
+
+// Bounds ctx by database.statement_timeout
+func (self *PostgresRateLimitStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if self.timeout > 0 {
+		return context.WithTimeout(ctx, self.timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// clock_timestamp() rather than now(), which is when the transaction began
+// and can be earlier than the updated_at of whoever held the lock before us
+func (self *PostgresRateLimitStore) take(ctx context.Context, key string, rate Rate) (*RateLimitResult, error) {
+	ctx, cancel := self.withTimeout(ctx)
+	defer cancel()
+
+	self.prune(time.Now())
+
+	tx := self.gorm.BeginTx(ctx, nil)
+
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	insert := tx.Exec(
+		"INSERT INTO rate_limit_buckets (id, tokens, updated_at) VALUES (?, ?, clock_timestamp()) ON CONFLICT (id) DO NOTHING",
+		key, float64(rate.Limit),
+	)
+
+	if insert.Error != nil {
+		tx.Rollback()
+		return nil, insert.Error
+	}
+
+	// Locks the row and refills it up to the database's clock
+	var refilled float64
+
+	err := tx.Raw(
+		"UPDATE rate_limit_buckets SET "+
+			"tokens = LEAST(?, tokens + GREATEST(0, EXTRACT(EPOCH FROM clock_timestamp() - updated_at)) * ?), "+
+			"updated_at = clock_timestamp() "+
+			"WHERE id = ? RETURNING tokens",
+		float64(rate.Limit), rate.refill(), key,
+	).Row().Scan(&refilled)
+
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	tokens, result := rate.take(refilled, 0)
+	update := tx.Exec("UPDATE rate_limit_buckets SET tokens = ? WHERE id = ?", tokens, key)
+
+	if update.Error != nil {
+		tx.Rollback()
+		return nil, update.Error
+	}
+
+	return result, tx.Commit().Error
+}
+
+// Buckets untouched for the longest period are full, same as missing ones.
+// Runs in the background, bounded by database.statement_timeout
+func (self *PostgresRateLimitStore) prune(now time.Time) {
+	self.Lock()
+	defer self.Unlock()
+
+	if now.Sub(self.prunedAt) < rateLimitPruneEvery {
+		return
+	}
+
+	self.prunedAt = now
+
+	go func() {
+		ctx, cancel := self.withTimeout(context.Background())
+		defer cancel()
+
+		_, err := self.gorm.DB().ExecContext(
+			ctx,
+			"DELETE FROM rate_limit_buckets WHERE updated_at < clock_timestamp() - $1 * interval '1 second'",
+			self.window.Seconds(),
+		)
+
+		if err != nil {
+			logger.Warn("Failed to prune rate limit buckets", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for _, test := range []struct {
+		value   string
+		rate    Rate
+		enabled bool
+		valid   bool
+	}{
+		{"30/1m", Rate{30, time.Minute}, true, true},
+		{"5/10s", Rate{5, 10 * time.Second}, true, true},
+		{"", Rate{}, false, true},
+		{"0", Rate{}, false, true},
+		{"30", Rate{}, false, false},
+		{"0/1m", Rate{}, false, false},
+		{"x/1m", Rate{}, false, false},
+		{"30/0s", Rate{}, false, false},
+		{"30/minute", Rate{}, false, false},
+	} {
+		rate, enabled, err := parseRate(test.value)
+
+		if rate != test.rate || enabled != test.enabled || (err == nil) != test.valid {
+			t.Errorf("%q: got %v %v %v", test.value, rate, enabled, err)
+		}
+	}
+}
+
+// 2/1m refills a token every 30 seconds
+func TestRateTake(t *testing.T) {
+	rate := Rate{2, time.Minute}
+
+	for _, test := range []struct {
+		name     string
+		tokens   float64
+		elapsed  time.Duration
+		left     float64
+		expected RateLimitResult
+	}{
+		{"full bucket", 2, 0, 1, RateLimitResult{Allowed: true, Limit: 2, Remaining: 1, Reset: 30 * time.Second}},
+		{"half a token", 0.5, 0, 0.5, RateLimitResult{Limit: 2, Reset: 45 * time.Second, RetryAfter: 15 * time.Second}},
+		{"refilled meanwhile", 0, 45 * time.Second, 0.5, RateLimitResult{Allowed: true, Limit: 2, Reset: 45 * time.Second}},
+		{"refills up to the limit", 1, time.Hour, 1, RateLimitResult{Allowed: true, Limit: 2, Remaining: 1, Reset: 30 * time.Second}},
+	} {
+		left, result := rate.take(test.tokens, test.elapsed)
+
+		if left != test.left || *result != test.expected {
+			t.Errorf("%s: got %v %+v, expected %v %+v", test.name, left, *result, test.left, test.expected)
+		}
+	}
+}
+
+func TestRateLimiterCheck(t *testing.T) {
+	limiter := &RateLimiter{
+		store:  &MemoryRateLimitStore{buckets: newLRU(10, 0)},
+		limits: map[string]Rate{"users": {2, time.Minute}},
+	}
+
+	client := func(ip string) context.Context {
+		return context.WithValue(context.Background(), rateLimitContextKey, &RateLimits{client: "ip:" + ip})
+	}
+
+	var (
+		first  = client("1.1.1.1")
+		second = client("2.2.2.2")
+		user   = withViewer(client("1.1.1.1"), &Viewer{ID: "voter", Authorized: true})
+	)
+
+	for _, test := range []struct {
+		name    string
+		ctx     context.Context
+		fields  []string
+		limited bool
+	}{
+		{"unlimited field", first, []string{"projects", "projects", "projects"}, false},
+		{"first request", first, []string{"users"}, false},
+		{"aliases take a token each", first, []string{"users", "users"}, true},
+		{"other client", second, []string{"users"}, false},
+		{"signed in behind the same IP", user, []string{"users", "users"}, false},
+		{"signed in, exhausted", user, []string{"users"}, true},
+	} {
+		errs := limiter.check(test.ctx, &QueryAnalysis{Fields: test.fields})
+
+		if limited := len(errs) > 0 && errs[0].Extensions["code"] == "RATE_LIMITED"; limited != test.limited {
+			t.Errorf("%s: limited %v, expected %v", test.name, limited, test.limited)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	rateLimitsFrom(first).writeHeaders(w)
+
+	for header, expected := range map[string]string{"RateLimit-Limit": "2", "RateLimit-Remaining": "0", "Retry-After": "30"} {
+		if got := w.Header().Get(header); got != expected {
+			t.Errorf("%s is %q, expected %q", header, got, expected)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		forwarded      []string
+		trustForwarded bool
+		ip             string
+	}{
+		{"direct", nil, false, "10.0.0.1"},
+		{"forwarded but not trusted", []string{"1.1.1.1"}, false, "10.0.0.1"},
+		{"behind a proxy", []string{"1.1.1.1"}, true, "1.1.1.1"},
+		{"spoofed entries before the proxy's", []string{"6.6.6.6, 1.1.1.1"}, true, "1.1.1.1"},
+		{"one header per hop", []string{"6.6.6.6", "1.1.1.1"}, true, "1.1.1.1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+
+		if ip := clientIP(r, test.trustForwarded); ip != test.ip {
+			t.Errorf("%s: got %s, expected %s", test.name, ip, test.ip)
+		}
+	}
+}
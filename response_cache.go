@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vektah/gqlparser/ast"
+	"github.com/vektah/gqlparser/formatter"
+)
+
+// Keeps the data of successful queries, so hot lists like the projects page
+// aren't rebuilt for every visitor. Writes trough Database purge it, on every
+// instance
+type ResponseCache interface {
+	get(key string) (*CachedResponse, bool)
+	// Dropped when the cache was purged since generation was taken, the
+	// response may have been built from rows written in between
+	set(key string, response *CachedResponse, ttl time.Duration, generation uint64)
+	purge()
+	// Taken before executing the operation, handed back to set
+	generation() uint64
+}
+
+// Freshness is kept along with the data, so hits carry the same ETag as
+// the execution that filled the cache
+type CachedResponse struct {
+	Data     json.RawMessage
+	Latest   time.Time
+	Entities int
+}
+
+func newResponseCache(config *Config) ResponseCache {
+	switch config.CacheBackend {
+	case "", "memory":
+		return newMemoryResponseCache(config.CacheSize)
+	case "none":
+		return nil
+	default:
+		fatal("Unknown cache.backend, expected memory or none", "backend", config.CacheBackend)
+	}
+
+	return nil
+}
+
+// Operations are cached for the shortest @cacheControl(maxAge: …) among
+// their fields, and only when every root field sets one. A PRIVATE field
+// anywhere keys the whole response by viewer instead of by role
+func cachePolicy(doc *ast.QueryDocument, op *ast.OperationDefinition) (time.Duration, bool) {
+	if op == nil || op.Operation != ast.Query {
+		return 0, false
+	}
+
+	var (
+		maxAge    time.Duration = -1
+		private   bool
+		cacheable = true
+	)
+
+	walkSelections(doc, op, func(field *ast.Field, depth int) {
+		if strings.HasPrefix(field.Name, "__") || field.Definition == nil {
+			return
+		}
+
+		directive := field.Definition.Directives.ForName("cacheControl")
+
+		if directive == nil {
+			if depth == 1 {
+				cacheable = false
+			}
+
+			return
+		}
+
+		if arg := directive.Arguments.ForName("maxAge"); arg != nil {
+			var seconds int
+			fmt.Sscan(arg.Value.Raw, &seconds)
+
+			if age := time.Duration(seconds) * time.Second; maxAge < 0 || age < maxAge {
+				maxAge = age
+			}
+		}
+
+		if arg := directive.Arguments.ForName("scope"); arg != nil && arg.Value.Raw == "PRIVATE" {
+			private = true
+		}
+	})
+
+	if !cacheable || maxAge <= 0 {
+		return 0, false
+	}
+
+	return maxAge, private
+}
+
+// Whitespace, comments and formatting don't split the cache
+func normalizeQuery(doc *ast.QueryDocument) string {
+	var buf bytes.Buffer
+	formatter.NewFormatter(&buf).FormatQueryDocument(doc)
+	return buf.String()
+}
+
+// Keyed by the normalized query, its variables and who is asking: the
+// viewer for PRIVATE responses, otherwise just the roles they hold
+func responseCacheKey(
+	ctx context.Context,
+	request *graphqlRequest,
+	analysis *QueryAnalysis,
+) string {
+	var (
+		viewer = viewerFrom(ctx)
+		scope  = "anonymous"
+	)
+
+	if analysis.Private {
+		scope = "viewer:" + viewer.ID
+	} else if user := viewer.User(ctx); user != nil {
+		roles := make([]string, 0, len(user.roles()))
+
+		for _, role := range user.roles() {
+			roles = append(roles, string(role))
+		}
+
+		sort.Strings(roles)
+		scope = "roles:" + strings.Join(roles, ",")
+	}
+
+	hash := sha256.New()
+	json.NewEncoder(hash).Encode([]interface{}{
+		analysis.Normalized,
+		request.OperationName,
+		request.Variables,
+		scope,
+	})
+
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// In memory backend
+//------------------------------------------------------------------------------
+
+type MemoryResponseCache struct {
+	sync.Mutex
+	items  *LRU
+	purges uint64 // The generation
+}
+
+func newMemoryResponseCache(size int) *MemoryResponseCache {
+	return &MemoryResponseCache{items: newLRU(size, 0)}
+}
+
+func (self *MemoryResponseCache) get(key string) (*CachedResponse, bool) {
+	if item, ok := self.items.get(key); ok {
+		return item.(*CachedResponse), true
+	}
+
+	return nil, false
+}
+
+func (self *MemoryResponseCache) set(key string, response *CachedResponse, ttl time.Duration, generation uint64) {
+	self.Lock()
+	defer self.Unlock()
+
+	if generation == self.purges {
+		self.items.setTTL(key, response, ttl)
+	}
+}
+
+func (self *MemoryResponseCache) purge() {
+	self.Lock()
+	defer self.Unlock()
+
+	self.purges++
+	self.items.clear()
+}
+
+func (self *MemoryResponseCache) generation() uint64 {
+	self.Lock()
+	defer self.Unlock()
+
+	return self.purges
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheGeneration(t *testing.T) {
+	var (
+		cache    = newMemoryResponseCache(10)
+		response = &CachedResponse{Data: json.RawMessage(`{}`)}
+	)
+
+	before := cache.generation()
+	cache.set("fresh", response, time.Minute, before)
+
+	// A write lands while the next operation executes
+	executing := cache.generation()
+	cache.purge()
+	cache.set("stale", response, time.Minute, executing)
+
+	if _, ok := cache.get("fresh"); ok {
+		t.Error("purge left an entry behind")
+	}
+
+	if _, ok := cache.get("stale"); ok {
+		t.Error("a response built before the purge was cached after it")
+	}
+
+	cache.set("fresh", response, time.Minute, cache.generation())
+
+	if _, ok := cache.get("fresh"); !ok {
+		t.Error("a response built after the purge wasn't cached")
+	}
+}
+
+// Writes on other instances arrive as events and purge the cache here too
+func TestResponseCacheRemotePurge(t *testing.T) {
+	db := newMemoryDatabase(newTestConfig(t))
+	db.cache = newMemoryResponseCache(10)
+	db.cache.set("projects", &CachedResponse{}, time.Minute, db.cache.generation())
+
+	db.evict(topicCachePurge, "")
+
+	if _, ok := db.cache.get("projects"); ok {
+		t.Error("remote purge left the response cached")
+	}
+}
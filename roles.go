@@ -0,0 +1,66 @@
+package main
+
+type Role string
+
+const (
+	RoleAdmin       Role = "ADMIN"
+	RoleModerator   Role = "MODERATOR"
+	RoleJudge       Role = "JUDGE"
+	RoleParticipant Role = "PARTICIPANT"
+)
+
+// Roles a role implicitly includes
+var roleGrants = map[Role][]Role{
+	RoleAdmin:       {RoleModerator, RoleJudge, RoleParticipant},
+	RoleModerator:   {RoleParticipant},
+	RoleJudge:       {RoleParticipant},
+	RoleParticipant: {},
+}
+
+func validRole(role Role) bool {
+	_, ok := roleGrants[role]
+	return ok
+}
+
+// Every signed in user is a participant, the rest is stored on the User row.
+// The legacy IsAdmin flag still counts as the admin role
+func (self User) roles() []Role {
+	// Banned users keep their data, but lose every role
+	if self.BannedAt != nil {
+		return []Role{}
+	}
+
+	roles := []Role{RoleParticipant}
+
+	if self.IsAdmin {
+		roles = append(roles, RoleAdmin)
+	}
+
+	for _, name := range self.Roles {
+		if role := Role(name); validRole(role) && !containsRole(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
+
+func containsRole(roles []Role, role Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (self User) hasRole(role Role) bool {
+	for _, held := range self.roles() {
+		if held == role || containsRole(roleGrants[held], role) {
+			return true
+		}
+	}
+
+	return false
+}
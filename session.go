@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "jwt"
+	csrfCookieName    = "csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+	stateCookieName   = "oauth_state"
+
+	// How long a login may take on Discord's side
+	stateCookieMaxAge = 10 * time.Minute
+)
+
+// Session cookies
+//------------------------------------------------------------------------------
+
+// Hands the signed token to the browser. In cookie mode the token is kept
+// away from scripts and a readable CSRF cookie is paired with it, which the
+// frontend has to echo back in the X-CSRF-Token header (double submit)
+func (self *JwtProvider) setSessionCookies(
+	w http.ResponseWriter,
+	token string,
+	expires time.Time,
+) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Expires:  expires,
+		HttpOnly: self.cookies,
+		Secure:   self.secure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+
+	if !self.cookies {
+		return nil
+	}
+
+	csrf, err := randomToken()
+
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Expires:  expires,
+		HttpOnly: false,
+		Secure:   self.secure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+
+	return nil
+}
+
+func (self *JwtProvider) clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			MaxAge:   -1,
+			Secure:   self.secure,
+			SameSite: http.SameSiteLaxMode,
+			Path:     "/",
+		})
+	}
+}
+
+// Returns the raw token and whether it came from the session cookie.
+// The Authorization header always wins over the cookie
+func (self *JwtProvider) sessionToken(r *http.Request) (string, bool) {
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+
+	if len(auth) == 2 && auth[0] == "Bearer" {
+		return auth[1], false
+	}
+
+	if self.cookies {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil && cookie.Value != "" {
+			return cookie.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// OAuth2 state
+//------------------------------------------------------------------------------
+
+// Every login gets its own state, kept in a short lived cookie only the
+// callback reads. A callback without the matching cookie wasn't started by
+// this browser
+func (self *JwtProvider) setStateCookie(w http.ResponseWriter) (string, error) {
+	state, err := randomToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    state,
+		MaxAge:   int(stateCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   self.secure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     callbackRoute,
+	})
+
+	return state, nil
+}
+
+// Compares the state Discord sent back against the cookie and clears it,
+// states are good for one callback only
+func (self *JwtProvider) checkStateCookie(w http.ResponseWriter, r *http.Request, state string) bool {
+	cookie, err := r.Cookie(stateCookieName)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   self.secure,
+		SameSite: http.SameSiteLaxMode,
+		Path:     callbackRoute,
+	})
+
+	return err == nil && cookie.Value != "" && state != "" &&
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) == 1
+}
+
+// CSRF
+//------------------------------------------------------------------------------
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Safe methods can't mutate anything, everything else has to carry the
+// same CSRF token in both the cookie and the header
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie, err := r.Cookie(csrfCookieName)
+
+	if err != nil || cookie.Value == "" {
+		loggerFrom(r.Context()).Warn("Missing CSRF cookie", "method", r.Method, "path", r.URL.Path)
+		return false
+	}
+
+	header := r.Header.Get(csrfHeaderName)
+
+	if subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+		loggerFrom(r.Context()).Warn("CSRF mismatch", "method", r.Method, "path", r.URL.Path)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Returned by conditional writes whose row changed since it was read, some
+// other request got there first
+var errConflict = errors.New("row changed concurrently")
+
+// Stores hide where Users, Projects, Raitings, Comments, judge scores and the
+// moderation log live, so Database and the loaders work the same on Postgres
+// and in memory. Lookups by a list of keys return whatever rows exist,
+// ordered by ID, missing keys are left out. Persisted queries and rate
+// limits have stores of their own
+
+type UserStore interface {
+	findUsers(ids []string) (Users, error)
+	allUsers() (Users, error)
+	// Loads the User with the same ID into user, or inserts it
+	firstOrCreateUser(user *User) error
+	saveUser(user *User) error
+	// Writes only project_id, a stale copy of the User can't undo a ban or
+	// a role change made in the meantime
+	setUserProject(userID string, projectID *uint) error
+}
+
+type ProjectStore interface {
+	findProjects(ids []string) (Projects, error)
+	projectsByOwner(ownerIDs []string) (Projects, error)
+	allProjects() (Projects, error)
+	insertProject(project *Project) error
+	saveProject(project *Project) error
+	// Write only the vote or judge averages and counts, then reload project,
+	// so a stale copy can't undo changes made to the other columns
+	saveRaitingAggregate(project *Project) error
+	saveJudgeAggregate(project *Project) error
+	removeProject(id uint) error
+}
+
+type RaitingStore interface {
+	findRaitings(ids []string) (Raitings, error)
+	raitingsByProject(projectIDs []string) (Raitings, error)
+	raitingsByOwner(ownerIDs []string) (Raitings, error)
+	allRaitings() (Raitings, error)
+	// A Users vote on a Project, nil without an error if there is none
+	findVote(ownerID string, projectID uint) (*Raiting, error)
+	insertRaiting(raiting *Raiting) error
+	saveRaiting(raiting *Raiting) error
+}
+
+type CommentStore interface {
+	findComments(ids []string) (Comments, error)
+	commentsByProject(projectIDs []string) (Comments, error)
+	insertComment(comment *Comment) error
+}
+
+type JudgeRaitingStore interface {
+	judgeRaitingsByProject(projectIDs []string) (JudgeRaitings, error)
+	// A Judges score for a Project, nil without an error if there is none
+	findJudgeScore(judgeID string, projectID uint) (*JudgeRaiting, error)
+	insertJudgeRaiting(raiting *JudgeRaiting) error
+	saveJudgeRaiting(raiting *JudgeRaiting) error
+}
+
+type ModerationStore interface {
+	// Runs action and appends entry to the log in one transaction, nothing
+	// is changed when either fails or ctx ends before the commit
+	moderate(ctx context.Context, entry *ModerationEntry, action func(tx ModerationTx) error) error
+	// Newest entries first
+	moderationLog(limit int, offset int) (ModerationEntries, error)
+}
+
+// The reads and writes moderation actions are made of, bound to the
+// transaction moderate runs them in. Reads don't lock, so writes that depend
+// on them are conditional and fail with errConflict when the row changed
+type ModerationTx interface {
+	findUsers(ids []string) (Users, error)
+	findProjects(ids []string) (Projects, error)
+	findRaitings(ids []string) (Raitings, error)
+	setBannedAt(userID string, at *time.Time) error
+	setUserProject(userID string, projectID *uint) error
+	setHiddenAt(projectID uint, at *time.Time) error
+	// Only while the User owns no other Project
+	claimProject(userID string, projectID uint) error
+	// Only while the Project is still owned by from
+	setOwner(projectID uint, from string, to string) error
+	// Only while the Raiting isn't voided yet
+	voidRaiting(raitingID uint, at time.Time) error
+}
+
+// Votes that haven't been voided, by value
+func (self Raitings) active() []Raiting {
+	items := make([]Raiting, 0, len(self))
+
+	for _, raiting := range self {
+		if raiting.VoidedAt == nil {
+			items = append(items, *raiting)
+		}
+	}
+
+	return items
+}
+
+// Loader queries
+//------------------------------------------------------------------------------
+
+func usersByID(db *Database, ids []string) (interface{}, error) {
+	return db.users.findUsers(ids)
+}
+
+func projectsByID(db *Database, ids []string) (interface{}, error) {
+	return db.projects.findProjects(ids)
+}
+
+func raitingsByID(db *Database, ids []string) (interface{}, error) {
+	return db.raitings.findRaitings(ids)
+}
+
+func raitingsByProject(db *Database, projectIDs []string) (interface{}, error) {
+	return db.raitings.raitingsByProject(projectIDs)
+}
+
+func raitingsByOwner(db *Database, ownerIDs []string) (interface{}, error) {
+	return db.raitings.raitingsByOwner(ownerIDs)
+}
+
+func projectsByOwner(db *Database, ownerIDs []string) (interface{}, error) {
+	return db.projects.projectsByOwner(ownerIDs)
+}
+
+func commentsByProject(db *Database, projectIDs []string) (interface{}, error) {
+	return db.comments.commentsByProject(projectIDs)
+}
+
+func judgeRaitingsByProject(db *Database, projectIDs []string) (interface{}, error) {
+	return db.judgeRaitings.judgeRaitingsByProject(projectIDs)
+}
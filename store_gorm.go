@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Implements every store on the gorm connection. gorm v1 can't hand a
+// context down to the driver on its own, so every call runs in a transaction
+// begun with ctx, bounded by database.statement_timeout. Queries of requests
+// that went away are cancelled, on SQLite too
+type GormStore struct {
+	gorm    *gorm.DB
+	ctx     context.Context // Set by Database.withContext, Background otherwise
+	timeout time.Duration   // database.statement_timeout, 0 disables it
+	inTx    bool            // Bound to the transaction of moderate already
+}
+
+func newGormStore(db *gorm.DB, ctx context.Context, timeout time.Duration) *GormStore {
+	return &GormStore{gorm: db, ctx: ctx, timeout: timeout}
+}
+
+// Runs the statements of one store call on ctx
+func (self *GormStore) run(statements func(db *gorm.DB) error) error {
+	if self.inTx {
+		return statements(self.gorm)
+	}
+
+	ctx := self.ctx
+
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return self.within(ctx, statements)
+}
+
+// A transaction bound to ctx and the statement timeout, rolled back when
+// statements fail or ctx ends before the commit
+func (self *GormStore) within(ctx context.Context, statements func(tx *gorm.DB) error) error {
+	var cancel context.CancelFunc
+
+	if self.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, self.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	defer cancel()
+
+	tx := self.gorm.BeginTx(ctx, nil)
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := statements(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// Users
+//------------------------------------------------------------------------------
+
+func (self *GormStore) findUsers(ids []string) (Users, error) {
+	var users Users
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("id IN (?)", ids).Order("id").Find(&users).Error
+	})
+
+	return users, err
+}
+
+func (self *GormStore) allUsers() (Users, error) {
+	var users Users
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Order("id").Find(&users).Error
+	})
+
+	return users, err
+}
+
+func (self *GormStore) firstOrCreateUser(user *User) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Where(&User{ID: user.ID}).FirstOrCreate(user).Error
+	})
+}
+
+func (self *GormStore) saveUser(user *User) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Save(user).Error
+	})
+}
+
+// Projects
+//------------------------------------------------------------------------------
+
+func (self *GormStore) findProjects(ids []string) (Projects, error) {
+	var projects Projects
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("id IN (?)", ids).Order("id").Find(&projects).Error
+	})
+
+	return projects, err
+}
+
+func (self *GormStore) projectsByOwner(ownerIDs []string) (Projects, error) {
+	var projects Projects
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("owner_id IN (?)", ownerIDs).Order("id").Find(&projects).Error
+	})
+
+	return projects, err
+}
+
+func (self *GormStore) allProjects() (Projects, error) {
+	var projects Projects
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Order("id").Find(&projects).Error
+	})
+
+	return projects, err
+}
+
+func (self *GormStore) insertProject(project *Project) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Create(project).Error
+	})
+}
+
+func (self *GormStore) saveProject(project *Project) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Save(project).Error
+	})
+}
+
+func (self *GormStore) saveRaitingAggregate(project *Project) error {
+	return self.updateProjectColumns(project, map[string]interface{}{
+		"raiting":       project.Raiting,
+		"raiting_count": project.RaitingCount,
+	})
+}
+
+func (self *GormStore) saveJudgeAggregate(project *Project) error {
+	return self.updateProjectColumns(project, map[string]interface{}{
+		"judge_raiting":       project.JudgeRaiting,
+		"judge_raiting_count": project.JudgeRaitingCount,
+	})
+}
+
+// updated_at is bumped along, it backs Last-Modified and the ETag
+func (self *GormStore) updateProjectColumns(project *Project, columns map[string]interface{}) error {
+	columns["updated_at"] = time.Now()
+
+	return self.run(func(tx *gorm.DB) error {
+		if err := tx.Model(&Project{}).Where("id = ?", project.ID).UpdateColumns(columns).Error; err != nil {
+			return err
+		}
+
+		return tx.First(project, project.ID).Error
+	})
+}
+
+func (self *GormStore) removeProject(id uint) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Where("id = ?", id).Delete(&Project{}).Error
+	})
+}
+
+// Raitings
+//------------------------------------------------------------------------------
+
+func (self *GormStore) findRaitings(ids []string) (Raitings, error) {
+	var raitings Raitings
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("id IN (?)", ids).Order("id").Find(&raitings).Error
+	})
+
+	return raitings, err
+}
+
+func (self *GormStore) raitingsByProject(projectIDs []string) (Raitings, error) {
+	var raitings Raitings
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("project_id IN (?)", projectIDs).Order("id").Find(&raitings).Error
+	})
+
+	return raitings, err
+}
+
+func (self *GormStore) raitingsByOwner(ownerIDs []string) (Raitings, error) {
+	var raitings Raitings
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("owner_id IN (?)", ownerIDs).Order("id").Find(&raitings).Error
+	})
+
+	return raitings, err
+}
+
+func (self *GormStore) allRaitings() (Raitings, error) {
+	var raitings Raitings
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Order("id").Find(&raitings).Error
+	})
+
+	return raitings, err
+}
+
+func (self *GormStore) findVote(ownerID string, projectID uint) (*Raiting, error) {
+	var raiting Raiting
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("owner_id = ? AND project_id = ?", ownerID, projectID).First(&raiting).Error
+	})
+
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+
+	return &raiting, err
+}
+
+func (self *GormStore) insertRaiting(raiting *Raiting) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Create(raiting).Error
+	})
+}
+
+func (self *GormStore) saveRaiting(raiting *Raiting) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Save(raiting).Error
+	})
+}
+
+// Comments
+//------------------------------------------------------------------------------
+
+func (self *GormStore) findComments(ids []string) (Comments, error) {
+	var comments Comments
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("id IN (?)", ids).Order("id").Find(&comments).Error
+	})
+
+	return comments, err
+}
+
+func (self *GormStore) commentsByProject(projectIDs []string) (Comments, error) {
+	var comments Comments
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("project_id IN (?)", projectIDs).Order("id").Find(&comments).Error
+	})
+
+	return comments, err
+}
+
+func (self *GormStore) insertComment(comment *Comment) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Create(comment).Error
+	})
+}
+
+// Judge raitings
+//------------------------------------------------------------------------------
+
+func (self *GormStore) judgeRaitingsByProject(projectIDs []string) (JudgeRaitings, error) {
+	var raitings JudgeRaitings
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("project_id IN (?)", projectIDs).Order("id").Find(&raitings).Error
+	})
+
+	return raitings, err
+}
+
+func (self *GormStore) findJudgeScore(judgeID string, projectID uint) (*JudgeRaiting, error) {
+	var raiting JudgeRaiting
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Where("judge_id = ? AND project_id = ?", judgeID, projectID).First(&raiting).Error
+	})
+
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+
+	return &raiting, err
+}
+
+func (self *GormStore) insertJudgeRaiting(raiting *JudgeRaiting) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Create(raiting).Error
+	})
+}
+
+func (self *GormStore) saveJudgeRaiting(raiting *JudgeRaiting) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Save(raiting).Error
+	})
+}
+
+// Moderation
+//------------------------------------------------------------------------------
+
+func (self *GormStore) moderate(
+	ctx context.Context,
+	entry *ModerationEntry,
+	action func(tx ModerationTx) error,
+) error {
+	return self.within(ctx, func(tx *gorm.DB) error {
+		if err := action(&GormStore{gorm: tx, inTx: true}); err != nil {
+			return err
+		}
+
+		return tx.Create(entry).Error
+	})
+}
+
+func (self *GormStore) moderationLog(limit int, offset int) (ModerationEntries, error) {
+	var entries ModerationEntries
+
+	err := self.run(func(db *gorm.DB) error {
+		return db.Order("id desc").Limit(limit).Offset(offset).Find(&entries).Error
+	})
+
+	return entries, err
+}
+
+func (self *GormStore) setBannedAt(userID string, at *time.Time) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Model(&User{}).Where("id = ?", userID).Update("banned_at", at).Error
+	})
+}
+
+func (self *GormStore) setUserProject(userID string, projectID *uint) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Model(&User{}).Where("id = ?", userID).Update("project_id", projectID).Error
+	})
+}
+
+func (self *GormStore) setHiddenAt(projectID uint, at *time.Time) error {
+	return self.run(func(db *gorm.DB) error {
+		return db.Model(&Project{}).Where("id = ?", projectID).Update("hidden_at", at).Error
+	})
+}
+
+func (self *GormStore) claimProject(userID string, projectID uint) error {
+	return self.run(func(db *gorm.DB) error {
+		return conditional(db.Model(&User{}).
+			Where("id = ? AND (project_id IS NULL OR project_id = ?)", userID, projectID).
+			Update("project_id", projectID))
+	})
+}
+
+func (self *GormStore) setOwner(projectID uint, from string, to string) error {
+	return self.run(func(db *gorm.DB) error {
+		return conditional(db.Model(&Project{}).
+			Where("id = ? AND owner_id = ?", projectID, from).
+			Update("owner_id", to))
+	})
+}
+
+func (self *GormStore) voidRaiting(raitingID uint, at time.Time) error {
+	return self.run(func(db *gorm.DB) error {
+		return conditional(db.Model(&Raiting{}).
+			Where("id = ? AND voided_at IS NULL", raitingID).
+			Update("voided_at", at))
+	})
+}
+
+// A concurrent writer holds the row lock until it commits, the WHERE is
+// checked again after that, so only one of them ever matches
+func conditional(req *gorm.DB) error {
+	if req.Error != nil {
+		return req.Error
+	}
+
+	if req.RowsAffected == 0 {
+		return errConflict
+	}
+
+	return nil
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Implements every store in memory, for tests and running without Postgres.
+// Rows are copied in and out, so callers can't change them behind its back
+type MemoryStore struct {
+	sync.RWMutex
+	users         map[string]User
+	projects      map[uint]Project
+	raitings      map[uint]Raiting
+	comments      map[uint]Comment
+	judgeRaitings map[uint]JudgeRaiting
+	moderation    ModerationEntries // Oldest first
+	lastID        uint
+}
+
+func newMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         make(map[string]User),
+		projects:      make(map[uint]Project),
+		raitings:      make(map[uint]Raiting),
+		comments:      make(map[uint]Comment),
+		judgeRaitings: make(map[uint]JudgeRaiting),
+	}
+}
+
+// A Database on a MemoryStore. Persisted queries and rate limits have memory
+// stores of their own
+func newMemoryDatabase(config *Config) *Database {
+	store := newMemoryStore()
+
+	return &Database{
+		fraud:         newFraudDetector(config),
+		events:        newMemoryBus(),
+		users:         store,
+		projects:      store,
+		raitings:      store,
+		comments:      store,
+		judgeRaitings: store,
+		moderation:    store,
+	}
+}
+
+// IDs are shared between tables, like a single sequence
+func (self *MemoryStore) nextID() uint {
+	self.lastID++
+	return self.lastID
+}
+
+func parseIDs(ids []string) map[uint]bool {
+	set := make(map[uint]bool, len(ids))
+
+	for _, id := range ids {
+		if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+			set[uint(n)] = true
+		}
+	}
+
+	return set
+}
+
+func stringSet(ids []string) map[string]bool {
+	set := make(map[string]bool, len(ids))
+
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	return set
+}
+
+// Users
+//------------------------------------------------------------------------------
+
+func (self *MemoryStore) selectUsers(match func(*User) bool) Users {
+	self.RLock()
+	defer self.RUnlock()
+
+	users := make(Users, 0)
+
+	for _, user := range self.users {
+		user := user
+
+		if match(&user) {
+			users = append(users, &user)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users
+}
+
+func (self *MemoryStore) findUsers(ids []string) (Users, error) {
+	set := stringSet(ids)
+	return self.selectUsers(func(user *User) bool { return set[user.ID] }), nil
+}
+
+func (self *MemoryStore) allUsers() (Users, error) {
+	return self.selectUsers(func(*User) bool { return true }), nil
+}
+
+func (self *MemoryStore) firstOrCreateUser(user *User) error {
+	self.Lock()
+	defer self.Unlock()
+
+	if existing, ok := self.users[user.ID]; ok {
+		*user = existing
+		return nil
+	}
+
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	self.users[user.ID] = *user
+	return nil
+}
+
+func (self *MemoryStore) saveUser(user *User) error {
+	self.Lock()
+	defer self.Unlock()
+
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+
+	user.UpdatedAt = time.Now()
+	self.users[user.ID] = *user
+	return nil
+}
+
+func (self *MemoryStore) setUserProject(userID string, projectID *uint) error {
+	self.Lock()
+	defer self.Unlock()
+
+	user, ok := self.users[userID]
+
+	if !ok {
+		return &NotFoundError{"User", userID}
+	}
+
+	user.ProjectID = projectID
+	user.UpdatedAt = time.Now()
+	self.users[userID] = user
+	return nil
+}
+
+// Projects
+//------------------------------------------------------------------------------
+
+func (self *MemoryStore) selectProjects(match func(*Project) bool) Projects {
+	self.RLock()
+	defer self.RUnlock()
+
+	projects := make(Projects, 0)
+
+	for _, project := range self.projects {
+		project := project
+
+		if match(&project) {
+			projects = append(projects, &project)
+		}
+	}
+
+	sort.Slice(projects, func(i, j int) bool { return projects[i].ID < projects[j].ID })
+	return projects
+}
+
+func (self *MemoryStore) findProjects(ids []string) (Projects, error) {
+	set := parseIDs(ids)
+	return self.selectProjects(func(project *Project) bool { return set[project.ID] }), nil
+}
+
+func (self *MemoryStore) projectsByOwner(ownerIDs []string) (Projects, error) {
+	set := stringSet(ownerIDs)
+	return self.selectProjects(func(project *Project) bool { return set[project.OwnerID] }), nil
+}
+
+func (self *MemoryStore) allProjects() (Projects, error) {
+	return self.selectProjects(func(*Project) bool { return true }), nil
+}
+
+func (self *MemoryStore) insertProject(project *Project) error {
+	self.Lock()
+	defer self.Unlock()
+
+	if project.ID != 0 {
+		return fmt.Errorf("Project %d already exists", project.ID)
+	}
+
+	project.ID = self.nextID()
+	project.CreatedAt = time.Now()
+	project.UpdatedAt = project.CreatedAt
+	self.projects[project.ID] = *project
+	return nil
+}
+
+func (self *MemoryStore) saveProject(project *Project) error {
+	if project.ID == 0 {
+		return self.insertProject(project)
+	}
+
+	self.Lock()
+	defer self.Unlock()
+
+	project.UpdatedAt = time.Now()
+	self.projects[project.ID] = *project
+	return nil
+}
+
+func (self *MemoryStore) saveRaitingAggregate(project *Project) error {
+	return self.updateProject(project, func(stored *Project) {
+		stored.Raiting = project.Raiting
+		stored.RaitingCount = project.RaitingCount
+	})
+}
+
+func (self *MemoryStore) saveJudgeAggregate(project *Project) error {
+	return self.updateProject(project, func(stored *Project) {
+		stored.JudgeRaiting = project.JudgeRaiting
+		stored.JudgeRaitingCount = project.JudgeRaitingCount
+	})
+}
+
+func (self *MemoryStore) updateProject(project *Project, update func(stored *Project)) error {
+	self.Lock()
+	defer self.Unlock()
+
+	stored, ok := self.projects[project.ID]
+
+	if !ok {
+		return &NotFoundError{"Project", project.String()}
+	}
+
+	update(&stored)
+	stored.UpdatedAt = time.Now()
+	self.projects[project.ID] = stored
+	*project = stored
+	return nil
+}
+
+func (self *MemoryStore) removeProject(id uint) error {
+	self.Lock()
+	defer self.Unlock()
+
+	delete(self.projects, id)
+	return nil
+}
+
+// Raitings
+//------------------------------------------------------------------------------
+
+func (self *MemoryStore) selectRaitings(match func(*Raiting) bool) Raitings {
+	self.RLock()
+	defer self.RUnlock()
+
+	raitings := make(Raitings, 0)
+
+	for _, raiting := range self.raitings {
+		raiting := raiting
+
+		if match(&raiting) {
+			raitings = append(raitings, &raiting)
+		}
+	}
+
+	sort.Slice(raitings, func(i, j int) bool { return raitings[i].ID < raitings[j].ID })
+	return raitings
+}
+
+func (self *MemoryStore) findRaitings(ids []string) (Raitings, error) {
+	set := parseIDs(ids)
+	return self.selectRaitings(func(raiting *Raiting) bool { return set[raiting.ID] }), nil
+}
+
+func (self *MemoryStore) raitingsByProject(projectIDs []string) (Raitings, error) {
+	set := parseIDs(projectIDs)
+	return self.selectRaitings(func(raiting *Raiting) bool { return set[raiting.ProjectID] }), nil
+}
+
+func (self *MemoryStore) raitingsByOwner(ownerIDs []string) (Raitings, error) {
+	set := stringSet(ownerIDs)
+	return self.selectRaitings(func(raiting *Raiting) bool { return set[raiting.OwnerID] }), nil
+}
+
+func (self *MemoryStore) allRaitings() (Raitings, error) {
+	return self.selectRaitings(func(*Raiting) bool { return true }), nil
+}
+
+func (self *MemoryStore) findVote(ownerID string, projectID uint) (*Raiting, error) {
+	raitings := self.selectRaitings(func(raiting *Raiting) bool {
+		return raiting.OwnerID == ownerID && raiting.ProjectID == projectID
+	})
+
+	if len(raitings) == 0 {
+		return nil, nil
+	}
+
+	return raitings[0], nil
+}
+
+func (self *MemoryStore) insertRaiting(raiting *Raiting) error {
+	self.Lock()
+	defer self.Unlock()
+
+	if raiting.ID != 0 {
+		return fmt.Errorf("Raiting %d already exists", raiting.ID)
+	}
+
+	raiting.ID = self.nextID()
+	raiting.CreatedAt = time.Now()
+	raiting.UpdatedAt = raiting.CreatedAt
+	self.raitings[raiting.ID] = *raiting
+	return nil
+}
+
+func (self *MemoryStore) saveRaiting(raiting *Raiting) error {
+	if raiting.ID == 0 {
+		return self.insertRaiting(raiting)
+	}
+
+	self.Lock()
+	defer self.Unlock()
+
+	raiting.UpdatedAt = time.Now()
+	self.raitings[raiting.ID] = *raiting
+	return nil
+}
+
+// Comments
+//------------------------------------------------------------------------------
+
+func (self *MemoryStore) selectComments(match func(*Comment) bool) Comments {
+	self.RLock()
+	defer self.RUnlock()
+
+	comments := make(Comments, 0)
+
+	for _, comment := range self.comments {
+		comment := comment
+
+		if match(&comment) {
+			comments = append(comments, &comment)
+		}
+	}
+
+	sort.Slice(comments, func(i, j int) bool { return comments[i].ID < comments[j].ID })
+	return comments
+}
+
+func (self *MemoryStore) findComments(ids []string) (Comments, error) {
+	set := parseIDs(ids)
+	return self.selectComments(func(comment *Comment) bool { return set[comment.ID] }), nil
+}
+
+func (self *MemoryStore) commentsByProject(projectIDs []string) (Comments, error) {
+	set := parseIDs(projectIDs)
+	return self.selectComments(func(comment *Comment) bool { return set[comment.ProjectID] }), nil
+}
+
+func (self *MemoryStore) insertComment(comment *Comment) error {
+	self.Lock()
+	defer self.Unlock()
+
+	if comment.ID != 0 {
+		return fmt.Errorf("Comment %d already exists", comment.ID)
+	}
+
+	comment.ID = self.nextID()
+	comment.CreatedAt = time.Now()
+	comment.UpdatedAt = comment.CreatedAt
+	self.comments[comment.ID] = *comment
+	return nil
+}
+
+// Judge raitings
+//------------------------------------------------------------------------------
+
+func (self *MemoryStore) selectJudgeRaitings(match func(*JudgeRaiting) bool) JudgeRaitings {
+	self.RLock()
+	defer self.RUnlock()
+
+	raitings := make(JudgeRaitings, 0)
+
+	for _, raiting := range self.judgeRaitings {
+		raiting := raiting
+
+		if match(&raiting) {
+			raitings = append(raitings, &raiting)
+		}
+	}
+
+	sort.Slice(raitings, func(i, j int) bool { return raitings[i].ID < raitings[j].ID })
+	return raitings
+}
+
+func (self *MemoryStore) judgeRaitingsByProject(projectIDs []string) (JudgeRaitings, error) {
+	set := parseIDs(projectIDs)
+	return self.selectJudgeRaitings(func(raiting *JudgeRaiting) bool { return set[raiting.ProjectID] }), nil
+}
+
+func (self *MemoryStore) findJudgeScore(judgeID string, projectID uint) (*JudgeRaiting, error) {
+	raitings := self.selectJudgeRaitings(func(raiting *JudgeRaiting) bool {
+		return raiting.JudgeID == judgeID && raiting.ProjectID == projectID
+	})
+
+	if len(raitings) == 0 {
+		return nil, nil
+	}
+
+	return raitings[0], nil
+}
+
+func (self *MemoryStore) insertJudgeRaiting(raiting *JudgeRaiting) error {
+	self.Lock()
+	defer self.Unlock()
+
+	if raiting.ID != 0 {
+		return fmt.Errorf("JudgeRaiting %d already exists", raiting.ID)
+	}
+
+	raiting.ID = self.nextID()
+	raiting.CreatedAt = time.Now()
+	raiting.UpdatedAt = raiting.CreatedAt
+	self.judgeRaitings[raiting.ID] = *raiting
+	return nil
+}
+
+func (self *MemoryStore) saveJudgeRaiting(raiting *JudgeRaiting) error {
+	if raiting.ID == 0 {
+		return self.insertJudgeRaiting(raiting)
+	}
+
+	self.Lock()
+	defer self.Unlock()
+
+	raiting.UpdatedAt = time.Now()
+	self.judgeRaitings[raiting.ID] = *raiting
+	return nil
+}
+
+// Moderation
+//------------------------------------------------------------------------------
+
+// Queues the writes of a moderation action, they're applied together with
+// the log entry once the action succeeds and every check still holds
+type memoryModerationTx struct {
+	*MemoryStore
+	writes []memoryWrite
+}
+
+// check runs under the same lock as every apply of the transaction, it sees
+// what concurrent transactions committed since the action read the rows
+type memoryWrite struct {
+	check func(store *MemoryStore) error // Optional
+	apply func(store *MemoryStore)
+}
+
+func (self *MemoryStore) moderate(
+	ctx context.Context,
+	entry *ModerationEntry,
+	action func(tx ModerationTx) error,
+) error {
+	tx := &memoryModerationTx{MemoryStore: self}
+
+	if err := action(tx); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	self.Lock()
+	defer self.Unlock()
+
+	for _, write := range tx.writes {
+		if write.check != nil {
+			if err := write.check(self); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, write := range tx.writes {
+		write.apply(self)
+	}
+
+	entry.ID = self.nextID()
+	entry.CreatedAt = time.Now()
+	stored := *entry
+	self.moderation = append(self.moderation, &stored)
+	return nil
+}
+
+func (self *MemoryStore) moderationLog(limit int, offset int) (ModerationEntries, error) {
+	self.RLock()
+	defer self.RUnlock()
+
+	entries := make(ModerationEntries, 0)
+
+	for i := len(self.moderation) - 1 - offset; i >= 0 && len(entries) < limit; i-- {
+		entry := *self.moderation[i]
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+// Like the conditional UPDATEs of GormStore, match tells whether the row
+// can still be written. A nil match always can
+func (self *memoryModerationTx) queueUser(id string, match func(user User) bool, update func(user *User)) error {
+	self.writes = append(self.writes, memoryWrite{
+		check: func(store *MemoryStore) error {
+			if user, ok := store.users[id]; ok && match != nil && !match(user) {
+				return errConflict
+			}
+
+			return nil
+		},
+		apply: func(store *MemoryStore) {
+			if user, ok := store.users[id]; ok {
+				update(&user)
+				user.UpdatedAt = time.Now()
+				store.users[id] = user
+			}
+		},
+	})
+
+	return nil
+}
+
+func (self *memoryModerationTx) queueProject(id uint, match func(project Project) bool, update func(project *Project)) error {
+	self.writes = append(self.writes, memoryWrite{
+		check: func(store *MemoryStore) error {
+			if project, ok := store.projects[id]; ok && match != nil && !match(project) {
+				return errConflict
+			}
+
+			return nil
+		},
+		apply: func(store *MemoryStore) {
+			if project, ok := store.projects[id]; ok {
+				update(&project)
+				project.UpdatedAt = time.Now()
+				store.projects[id] = project
+			}
+		},
+	})
+
+	return nil
+}
+
+func (self *memoryModerationTx) setBannedAt(userID string, at *time.Time) error {
+	return self.queueUser(userID, nil, func(user *User) { user.BannedAt = at })
+}
+
+func (self *memoryModerationTx) setUserProject(userID string, projectID *uint) error {
+	return self.queueUser(userID, nil, func(user *User) { user.ProjectID = projectID })
+}
+
+func (self *memoryModerationTx) setHiddenAt(projectID uint, at *time.Time) error {
+	return self.queueProject(projectID, nil, func(project *Project) { project.HiddenAt = at })
+}
+
+func (self *memoryModerationTx) claimProject(userID string, projectID uint) error {
+	return self.queueUser(
+		userID,
+		func(user User) bool { return user.ProjectID == nil || *user.ProjectID == projectID },
+		func(user *User) { user.ProjectID = &projectID },
+	)
+}
+
+func (self *memoryModerationTx) setOwner(projectID uint, from string, to string) error {
+	return self.queueProject(
+		projectID,
+		func(project Project) bool { return project.OwnerID == from },
+		func(project *Project) { project.OwnerID = to },
+	)
+}
+
+func (self *memoryModerationTx) voidRaiting(raitingID uint, at time.Time) error {
+	self.writes = append(self.writes, memoryWrite{
+		check: func(store *MemoryStore) error {
+			if raiting, ok := store.raitings[raitingID]; ok && raiting.VoidedAt != nil {
+				return errConflict
+			}
+
+			return nil
+		},
+		apply: func(store *MemoryStore) {
+			if raiting, ok := store.raitings[raitingID]; ok {
+				raiting.VoidedAt = &at
+				raiting.UpdatedAt = time.Now()
+				store.raitings[raitingID] = raiting
+			}
+		},
+	})
+
+	return nil
+}
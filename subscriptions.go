@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphql-ws, the subprotocol spoken by subscriptions-transport-ws / Apollo
+const (
+	wsConnectionInit      = "connection_init"
+	wsConnectionAck       = "connection_ack"
+	wsConnectionError     = "connection_error"
+	wsConnectionKeepAlive = "ka"
+	wsConnectionTerminate = "connection_terminate"
+	wsStart               = "start"
+	wsData                = "data"
+	wsError               = "error"
+	wsComplete            = "complete"
+	wsStop                = "stop"
+)
+
+const (
+	wsKeepAlive    = 25 * time.Second
+	wsReadTimeout  = 60 * time.Second
+	wsWriteTimeout = 10 * time.Second
+)
+
+type wsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type wsConnection struct {
+	graphql *GraphQL
+	conn    *websocket.Conn
+	ctx     context.Context
+	writeMu sync.Mutex
+
+	sync.Mutex
+	operations map[string]*wsOperation
+}
+
+type wsOperation struct {
+	cancel context.CancelFunc
+}
+
+func (self *GraphQL) upgrader() *websocket.Upgrader {
+	return &websocket.Upgrader{
+		Subprotocols: []string{"graphql-ws"},
+		CheckOrigin:  self.checkOrigin,
+	}
+}
+
+// Browsers attach the session cookie to cross site WebSocket handshakes too,
+// and don't apply CORS to them, so in cookie mode only same host origins and
+// those allowed by cors.allowed_origins are accepted. With bearer tokens
+// there's nothing ambient to hijack
+func (self *GraphQL) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" || !self.state.config.SessionCookie {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	if self.state.cors != nil && self.state.cors.allowed(origin) {
+		return true
+	}
+
+	loggerFrom(r.Context()).Warn("Rejected WebSocket origin", "origin", origin)
+	return false
+}
+
+// /graphql with an Upgrade: websocket header
+func (self *GraphQL) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := self.upgrader().Upgrade(w, r, nil)
+
+	if err != nil {
+		loggerFrom(r.Context()).Warn("WebSocket upgrade failed", "error", err)
+		return
+	}
+
+	// Deadlines from the http.Server carry over to the hijacked connection
+	conn.SetWriteDeadline(time.Time{})
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	c := &wsConnection{
+		graphql:    self,
+		conn:       conn,
+		ctx:        ctx,
+		operations: make(map[string]*wsOperation),
+	}
+
+	c.readLoop()
+	conn.Close()
+}
+
+func (self *wsConnection) write(message *wsMessage) error {
+	self.writeMu.Lock()
+	defer self.writeMu.Unlock()
+
+	self.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return self.conn.WriteJSON(message)
+}
+
+func (self *wsConnection) writePayload(id string, kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	return self.write(&wsMessage{ID: id, Type: kind, Payload: data})
+}
+
+func (self *wsConnection) keepAlive() {
+	ticker := time.NewTicker(wsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.ctx.Done():
+			return
+		case <-ticker.C:
+			self.writeMu.Lock()
+			err := self.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			self.writeMu.Unlock()
+
+			if err != nil || self.write(&wsMessage{Type: wsConnectionKeepAlive}) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (self *wsConnection) readLoop() {
+	initialized := false
+
+	for {
+		var message wsMessage
+
+		if err := self.conn.ReadJSON(&message); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				loggerFrom(self.ctx).Warn("WebSocket read failed", "error", err)
+			}
+
+			return
+		}
+
+		self.conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+
+		switch message.Type {
+		case wsConnectionInit:
+			if initialized {
+				continue
+			}
+
+			if err := self.init(message.Payload); err != nil {
+				self.writePayload("", wsConnectionError, map[string]string{"message": err.Error()})
+				return
+			}
+
+			initialized = true
+			self.write(&wsMessage{Type: wsConnectionAck})
+			self.write(&wsMessage{Type: wsConnectionKeepAlive})
+			go self.keepAlive()
+
+		case wsStart:
+			if !initialized {
+				self.writePayload(message.ID, wsError, map[string]string{"message": "connection_init required"})
+				continue
+			}
+
+			self.start(message.ID, message.Payload)
+
+		case wsStop:
+			self.stop(message.ID)
+
+		case wsConnectionTerminate:
+			return
+
+		default:
+			self.writePayload(message.ID, wsError, map[string]string{"message": "unknown message type " + message.Type})
+		}
+	}
+}
+
+// Browsers can't set headers on a WebSocket, so the token may come with
+// connection_init instead. It replaces whatever the handshake carried
+func (self *wsConnection) init(payload json.RawMessage) error {
+	var params struct {
+		AuthToken     string `json:"authToken"`
+		Authorization string `json:"Authorization"`
+	}
+
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &params); err != nil {
+			return err
+		}
+	}
+
+	token := params.AuthToken
+
+	if token == "" {
+		token = strings.TrimPrefix(params.Authorization, "Bearer ")
+	}
+
+	if token == "" {
+		return nil
+	}
+
+	parsed, err := self.graphql.state.jwt.validateToken(&token)
+
+	if err != nil {
+		return err
+	}
+
+	if claims, ok := parsed.Claims.(jwt.MapClaims); ok && parsed.Valid {
+		if userID, ok := claims["jti"].(string); ok {
+			self.ctx = withViewer(self.ctx, &Viewer{ID: userID, Authorized: true})
+			return nil
+		}
+	}
+
+	return errors.New("invalid token claims")
+}
+
+func (self *wsConnection) start(id string, payload json.RawMessage) {
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+		Extensions    *requestExtensions     `json:"extensions"`
+	}
+
+	if err := json.Unmarshal(payload, &params); err != nil {
+		self.writePayload(id, wsError, map[string]string{"message": err.Error()})
+		return
+	}
+
+	query, queryErr := self.graphql.queries.resolve(params.Query, params.Extensions)
+
+	if queryErr != nil {
+		self.writePayload(id, wsError, queryErr)
+		return
+	}
+
+	// A client reusing an ID replaces the old operation
+	self.stop(id)
+
+	ctx, cancel := context.WithCancel(self.graphql.loaders.attach(self.ctx))
+	op := &wsOperation{cancel}
+
+	self.Lock()
+	self.operations[id] = op
+	self.Unlock()
+
+	analysis, errs := self.graphql.guard.check(ctx, query, params.OperationName, false)
+
+	if errs == nil {
+		errs = self.graphql.state.limiter.check(ctx, analysis)
+	}
+
+	if errs != nil {
+		self.writePayload(id, wsData, &graphql.Response{Errors: errs})
+		self.complete(id, op)
+		return
+	}
+
+	responses, err := self.graphql.schema.Subscribe(ctx, query, params.OperationName, params.Variables)
+
+	if err != nil {
+		self.writePayload(id, wsError, map[string]string{"message": err.Error()})
+		self.complete(id, op)
+		return
+	}
+
+	go func() {
+		for response := range responses {
+			if err := self.writePayload(id, wsData, response); err != nil {
+				loggerFrom(self.ctx).Warn("WebSocket write failed", "error", err)
+				break
+			}
+		}
+
+		self.complete(id, op)
+	}()
+}
+
+func (self *wsConnection) stop(id string) {
+	self.Lock()
+	op, ok := self.operations[id]
+	delete(self.operations, id)
+	self.Unlock()
+
+	if ok {
+		op.cancel()
+	}
+}
+
+// Tells the client the server ended the operation. Does nothing if the client
+// already stopped it, or started a new operation under the same ID
+func (self *wsConnection) complete(id string, op *wsOperation) {
+	self.Lock()
+	current := self.operations[id] == op
+	if current {
+		delete(self.operations, id)
+	}
+	self.Unlock()
+
+	op.cancel()
+
+	if current {
+		self.write(&wsMessage{ID: id, Type: wsComplete})
+	}
+}
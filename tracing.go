@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/graph-gophers/graphql-go/errors"
+	"github.com/graph-gophers/graphql-go/introspection"
+	gqltrace "github.com/graph-gophers/graphql-go/trace"
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	dataloader "gopkg.in/nicksrandall/dataloader.v5"
+)
+
+// Resolves to a no-op tracer until newTracing installs a provider
+var tracer = otel.Tracer("grip")
+
+const (
+	dbContextKey = "tracing:context"
+	dbSpanKey    = "tracing:span"
+)
+
+// Installs the exporter picked by tracing.exporter. The returned func
+// flushes spans that are still buffered, call it on shutdown
+func newTracing(config *Config) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+
+	switch config.TracingExporter {
+	case "", "none":
+		return func(context.Context) error { return nil }
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		exporter, err = otlptracehttp.New(
+			context.Background(),
+			otlptracehttp.WithEndpoint(config.TracingEndpoint),
+			otlptracehttp.WithInsecure(),
+		)
+	default:
+		fatal("Unknown tracing.exporter, expected none, stdout or otlp", "exporter", config.TracingExporter)
+	}
+
+	if err != nil {
+		fatal("Failed to create the trace exporter", "exporter", config.TracingExporter, "error", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.TracingSampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "grip"))),
+	)
+
+	otel.SetTracerProvider(provider)
+	logger.Info("Exporting traces", "exporter", config.TracingExporter)
+
+	return provider.Shutdown
+}
+
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// HTTP
+//------------------------------------------------------------------------------
+
+// Continues the trace from an incoming traceparent header, if there is one
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			sw    = &StatusWriter{ResponseWriter: w, StatusCode: http.StatusOK}
+			ctx   = otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			route = r.URL.Path
+		)
+
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx, span := tracer.Start(
+			ctx,
+			r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.status_code", sw.StatusCode))
+
+		if sw.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.StatusCode))
+		}
+	})
+}
+
+// GraphQL
+//------------------------------------------------------------------------------
+
+// Hooked into graphql-go, which calls it around execution and every field
+type GraphQLTracer struct{}
+
+func (GraphQLTracer) TraceQuery(
+	ctx context.Context,
+	queryString string,
+	operationName string,
+	variables map[string]interface{},
+	varTypes map[string]*introspection.Type,
+) (context.Context, gqltrace.TraceQueryFinishFunc) {
+	ctx, span := tracer.Start(ctx, "graphql.execute")
+
+	if operationName != "" {
+		span.SetAttributes(attribute.String("graphql.operation.name", operationName))
+	}
+
+	return ctx, func(errs []*errors.QueryError) {
+		if len(errs) > 0 {
+			failSpan(span, errs[0])
+		}
+
+		span.End()
+	}
+}
+
+// Trivial fields are plain struct reads, they would only add noise
+func (GraphQLTracer) TraceField(
+	ctx context.Context,
+	label string,
+	typeName string,
+	fieldName string,
+	trivial bool,
+	args map[string]interface{},
+) (context.Context, gqltrace.TraceFieldFinishFunc) {
+	if trivial {
+		return ctx, func(*errors.QueryError) {}
+	}
+
+	ctx, span := tracer.Start(ctx, typeName+"."+fieldName, trace.WithAttributes(
+		attribute.String("graphql.type", typeName),
+		attribute.String("graphql.field", fieldName),
+	))
+
+	return ctx, func(err *errors.QueryError) {
+		if err != nil {
+			failSpan(span, err)
+		}
+
+		span.End()
+	}
+}
+
+// Dataloaders
+//------------------------------------------------------------------------------
+
+// Batches run on the context of the Load that opened them
+func traceBatch(loader key, batch dataloader.BatchFunc) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		ctx, span := tracer.Start(ctx, "dataloader."+string(loader), trace.WithAttributes(
+			attribute.Int("dataloader.keys", len(keys)),
+		))
+		defer span.End()
+
+		results := batch(ctx, keys)
+
+		for _, result := range results {
+			if result != nil && result.Error != nil {
+				if _, missing := result.Error.(*NotFoundError); !missing {
+					failSpan(span, result.Error)
+					break
+				}
+			}
+		}
+
+		return results
+	}
+}
+
+// Database
+//------------------------------------------------------------------------------
+
+// gorm has no context of its own, so it's carried as a value on the
+// connection dbFrom hands out. Statements ran without one start a new trace
+func traceDB(db *Database) {
+	if db.gorm == nil {
+		return
+	}
+
+	callbacks := db.gorm.Callback()
+
+	for operation, processor := range map[string]func() *gorm.CallbackProcessor{
+		"create":    callbacks.Create,
+		"query":     callbacks.Query,
+		"update":    callbacks.Update,
+		"delete":    callbacks.Delete,
+		"row_query": callbacks.RowQuery,
+	} {
+		processor().Before("gorm:"+operation).Register("tracing:before_"+operation, startSpan(operation))
+		processor().After("gorm:"+operation).Register("tracing:after_"+operation, endSpan)
+	}
+}
+
+func startSpan(operation string) func(scope *gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		ctx := context.Background()
+
+		if value, ok := scope.Get(dbContextKey); ok {
+			ctx = value.(context.Context)
+		}
+
+		_, span := tracer.Start(
+			ctx,
+			fmt.Sprintf("gorm.%s %s", operation, scope.TableName()),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", scope.Dialect().GetName()),
+				attribute.String("db.sql.table", scope.TableName()),
+			),
+		)
+
+		scope.Set(dbSpanKey, span)
+	}
+}
+
+// Statements are recorded with their placeholders, never with the values
+func endSpan(scope *gorm.Scope) {
+	value, ok := scope.Get(dbSpanKey)
+
+	if !ok {
+		return
+	}
+
+	span := value.(trace.Span)
+	span.SetAttributes(attribute.String("db.statement", scope.SQL))
+
+	if scope.HasError() && !gorm.IsRecordNotFoundError(scope.DB().Error) {
+		failSpan(span, scope.DB().Error)
+	}
+
+	span.End()
+}
+
+// A copy whose statements are traced as children of ctx and logged with
+// its request ID
+func (self *Database) withContext(ctx context.Context) *Database {
+	scoped := *self
+	scoped.logger = loggerFrom(ctx)
+
+	if self.gorm == nil {
+		return &scoped
+	}
+
+	store := newGormStore(self.gorm.Set(dbContextKey, ctx), ctx, self.timeout)
+	store.gorm.SetLogger(GormLogger{scoped.logger})
+
+	scoped.gorm = store.gorm
+	scoped.users = store
+	scoped.projects = store
+	scoped.raitings = store
+	scoped.comments = store
+	scoped.judgeRaitings = store
+	scoped.moderation = store
+
+	return &scoped
+}